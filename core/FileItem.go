@@ -13,16 +13,32 @@ type FileItem struct {
 	Size          int64
 	ModTime       int64 // Added: Unix timestamp of modification
 	Hash          sql.NullString
-	HumanizedSize string // Added: Human-readable size string
+	HashAlgorithm sql.NullString // Name of the hash algorithm that made Hash
+	HumanizedSize string         // Added: Human-readable size string
+	PartialHash   sql.NullString // Hash of the head (and tail) of the file, prefixed with the partial hash spec
+	LinkTarget    sql.NullString // Set if the file was replaced by a symbolic link to this target
 }
 
 type DuplicateGroup struct {
-	GroupID   int      // Eindeutige ID der Gruppe
-	Hash      string   // Hash-Wert der Datei
-	Size      int64    // Größe der Datei in Byte
-	HumanSize string   // Größe der Datei in menschenlesbarer Form (z.B. "10 MB")
-	FileCount int      // Anzahl der Dateien in der Gruppe
-	Files     []string // Liste der Dateipfade in der Gruppe
+	GroupID    int      // Eindeutige ID der Gruppe
+	Hash       string   // Hash-Wert der Datei
+	Size       int64    // Größe der Datei in Byte
+	HumanSize  string   // Größe der Datei in menschenlesbarer Form (z.B. "10 MB")
+	FileCount  int      // Anzahl der Dateien in der Gruppe
+	Method     string   // Methode der Prüfung (z.B. "full")
+	VerifiedAt int64    // Zeitpunkt der Prüfung als Unix-Timestamp
+	Files      []string // Liste der Dateipfade in der Gruppe
+}
+
+// A group of identical files, verified by the scanner
+type FileGroup struct {
+	GroupID       int64
+	Hash          string
+	HashAlgorithm sql.NullString
+	Size          int64
+	VerifiedAt    int64  // Unix timestamp of the verification
+	Method        string // How the content was compared: full, sample or legacy (grouped by hash before groups were stored)
+	Files         []*FileItem
 }
 
 func generateGUID() string {
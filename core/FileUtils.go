@@ -2,60 +2,87 @@ package core
 
 import (
 	"bytes"
-	"crypto/md5"
-	"crypto/sha256"
+	"context"
 	"encoding/hex"
 	"fmt"
-	"hash"
 	"io"
-	"math/rand"
+	"math/rand/v2"
 	"os"
-	"time"
+	"slices"
 )
 
-const SizeThreshold = 2 * 1024 * 1024 * 1024 // 2GB
+const DefaultPartialHashSize = 4096 // 4KB
 
-func CalculateFileHash(filePath string, fileSize int64) (string, error) {
-	if fileSize > SizeThreshold {
-		return CalculateFileHashSHA256(filePath)
-	} else {
-		return CalculateFileHashMD5(filePath)
-	}
+// Calculates the hash of the whole file with the given hash algorithm
+func CalculateFileHash(filePath string, hasher Hasher) (string, error) {
+	return CalculateFileHashContext(context.Background(), filePath, hasher)
 }
 
-func CalculateFileHashMD5(filePath string) (string, error) {
+// Calculates the hash of the whole file, stops with the error of the context when it is cancelled
+func CalculateFileHashContext(ctx context.Context, filePath string, hasher Hasher) (string, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	var h hash.Hash
-	h = md5.New()
+	h := hasher.New()
 
-	if _, err = io.Copy(h, f); err != nil {
+	if _, err = io.Copy(h, &contextReader{ctx: ctx, r: f}); err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func CalculateFileHashSHA256(filePath string) (string, error) {
+// Reader that fails with the error of the context once it is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Describes how a partial hash was made. Stored in front of the partial hash,
+// so hashes made with different settings are never compared.
+func PartialHashSpec(hasher Hasher, headSize int64, withTail bool) string {
+	if withTail {
+		return fmt.Sprintf("%s/%d+%d", hasher.Name(), headSize, headSize)
+	}
+	return fmt.Sprintf("%s/%d", hasher.Name(), headSize)
+}
+
+// Hashes the first headSize bytes of a file and, if withTail is set, the last headSize bytes.
+// The result is prefixed with the partial hash spec.
+func CalculatePartialFileHash(filePath string, fileSize int64, hasher Hasher, headSize int64, withTail bool) (string, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	var h hash.Hash
-	h = sha256.New()
+	h := hasher.New()
 
-	if _, err = io.Copy(h, f); err != nil {
+	if _, err = io.CopyN(h, f, min(headSize, fileSize)); err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+
+	if withTail && fileSize > headSize {
+		tailOffset := max(fileSize-headSize, headSize)
+		if _, err = io.Copy(h, io.NewSectionReader(f, tailOffset, fileSize-tailOffset)); err != nil {
+			return "", err
+		}
+	}
+
+	return PartialHashSpec(hasher, headSize, withTail) + ":" + hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func CompareFilesBinary(path1, path2 string) (bool, error) {
+// Compares the whole content of two files, chunk by chunk. Stops with the error of the context once it is cancelled.
+func CompareFilesBinary(ctx context.Context, path1, path2 string) (bool, error) {
 	f1, err := os.Open(path1)
 	if err != nil {
 		return false, err
@@ -73,102 +100,91 @@ func CompareFilesBinary(path1, path2 string) (bool, error) {
 	buf2 := make([]byte, chunkSize)
 
 	for {
-		n1, err1 := f1.Read(buf1)
-		n2, err2 := f2.Read(buf2)
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		// ReadFull, a single Read may return less than a chunk
+		n1, err1 := io.ReadFull(f1, buf1)
+		n2, err2 := io.ReadFull(f2, buf2)
 
-		if err1 != nil && err1 != io.EOF {
+		if err1 != nil && err1 != io.EOF && err1 != io.ErrUnexpectedEOF {
 			return false, err1
 		}
-		if err2 != nil && err2 != io.EOF {
+		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
 			return false, err2
 		}
-		if n1 != n2 {
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
 			return false, nil
 		}
-		if err1 == io.EOF && err2 == io.EOF {
-			return true, nil
-		}
-		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
-			return false, nil
+		if err1 != nil || err2 != nil {
+			return err1 != nil && err2 != nil, nil
 		}
 	}
 }
 
-func compareFilesBinarySampleSize(filePathA, filePathB string, sampleSize int) (bool, error) {
-
-	// Open both files
-	fileA, err := os.Open(filePathA)
-	if err != nil {
-		return false, fmt.Errorf("failed to open file A: %w", err)
+// Returns the offsets of the blocks the sample verify mode compares in a file of the size, first block first.
+// The first and the last block are always part of the sample, the others are picked with a generator seeded
+// with sampleSeed and the size. Returns nil if the file has no more blocks than the sample.
+func sampleOffsets(size, blockSize int64, blocks int) []int64 {
+	if blockSize <= 0 || blocks < 2 {
+		return nil
 	}
-	defer fileA.Close()
-
-	fileB, err := os.Open(filePathB)
-	if err != nil {
-		return false, fmt.Errorf("failed to open file B: %w", err)
+	fileBlocks := (size + blockSize - 1) / blockSize
+	if fileBlocks <= int64(blocks) {
+		return nil
 	}
-	defer fileB.Close()
 
-	// Get file sizes
-	statA, err := fileA.Stat()
-	if err != nil {
-		return false, fmt.Errorf("failed to stat file A: %w", err)
-	}
-
-	statB, err := fileB.Stat()
-	if err != nil {
-		return false, fmt.Errorf("failed to stat file B: %w", err)
-	}
-
-	// Files must be same size
-	if statA.Size() != statB.Size() {
-		return false, nil
+	rng := rand.New(rand.NewPCG(sampleSeed, uint64(size)))
+	picked := map[int64]bool{0: true, fileBlocks - 1: true}
+	for len(picked) < blocks {
+		picked[rng.Int64N(fileBlocks)] = true
 	}
 
-	fileSize := statA.Size()
-	if fileSize == 0 {
-		return true, nil // Both files are empty
+	offsets := make([]int64, 0, blocks)
+	for block := range picked {
+		offsets = append(offsets, block*blockSize)
 	}
+	slices.Sort(offsets)
+	return offsets
+}
 
-	// Adjust sample size if file is smaller
-	if int64(sampleSize) > fileSize {
-		sampleSize = int(fileSize)
+// Compares the blocks at the offsets of two files of the same size. Stops with the error of the context once it is cancelled.
+func CompareFilesSampled(ctx context.Context, path1, path2 string, offsets []int64, blockSize int64) (bool, error) {
+	f1, err := os.Open(path1)
+	if err != nil {
+		return false, err
 	}
+	defer f1.Close()
 
-	// Generate random positions
-	positions := make([]int64, sampleSize)
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-	for i := 0; i < sampleSize; i++ {
-		positions[i] = rng.Int63n(fileSize)
+	f2, err := os.Open(path2)
+	if err != nil {
+		return false, err
 	}
+	defer f2.Close()
 
-	// Compare bytes at random positions
-	byteA := make([]byte, 1)
-	byteB := make([]byte, 1)
+	buf1 := make([]byte, blockSize)
+	buf2 := make([]byte, blockSize)
 
-	for _, pos := range positions {
-		// Read byte from file A
-		_, err := fileA.ReadAt(byteA, pos)
-		if err != nil {
-			return false, fmt.Errorf("failed to read from file A at position %d: %w", pos, err)
+	for _, offset := range offsets {
+		if err := ctx.Err(); err != nil {
+			return false, err
 		}
-
-		// Read byte from file B
-		_, err = fileB.ReadAt(byteB, pos)
-		if err != nil {
-			return false, fmt.Errorf("failed to read from file B at position %d: %w", pos, err)
+		// the last block may be shorter, ReadAt returns io.EOF with it
+		n1, err := f1.ReadAt(buf1, offset)
+		if err != nil && err != io.EOF {
+			return false, fmt.Errorf("failed to read %s at offset %d: %w", path1, offset, err)
 		}
-
-		// Compare bytes
-		if byteA[0] != byteB[0] {
+		n2, err := f2.ReadAt(buf2, offset)
+		if err != nil && err != io.EOF {
+			return false, fmt.Errorf("failed to read %s at offset %d: %w", path2, offset, err)
+		}
+		if n1 != n2 || !bytes.Equal(buf1[:n1], buf2[:n2]) {
 			return false, nil
 		}
 	}
-
 	return true, nil
 }
 
-//
 //func compareFilesBinarySampleSize(path1, path2 string, sampleSize int64) (bool, error) {
 //	// Get file info first
 //	info1, err := os.Stat(path1)
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Replaces every duplicate with a hard link to the kept file of its group
+func (a *App) HardlinkDuplicateFiles() {
+	a.hardlinkDuplicates(a.decideDuplicateGroups())
+}
+
+// Replaces the files of each decision with hard links to its kept file
+func (a *App) hardlinkDuplicates(decisions []keepDecision) {
+	linkedCount := 0
+	savedSize := int64(0)
+	operation := a.newOperation(ActionHardlink)
+
+	for _, decision := range decisions {
+		keep := decision.keep
+		for _, file := range decision.rest {
+			if a.config.DryRun {
+				fmt.Printf("Would hardlink %s to %s\n", file.Path, keep.Path)
+				continue
+			}
+
+			if err := a.hardlinkFile(keep, file); err != nil {
+				fmt.Fprintf(os.Stderr, "Error linking %s: %v\n", file.Path, err)
+				continue
+			}
+			operation.record(file, file.Path, keep.Path)
+
+			if err := a.index.ReplacedByLink(file, keep, ""); err != nil {
+				fmt.Fprintf(os.Stderr, "Error updating database for %s: %v\n", file.Path, err)
+			}
+
+			linkedCount++
+			savedSize += file.Size
+		}
+	}
+
+	fmt.Printf("Replaced %d duplicate files with hard links, %s saved\n", linkedCount, HumanizeBytes(savedSize))
+	operation.finish()
+}
+
+// Replaces every duplicate with a symbolic link to the kept file of its group.
+// With relative set the link targets are relative to the directory of the link.
+func (a *App) SymlinkDuplicateFiles(relative bool) {
+	linkedCount := 0
+	savedSize := int64(0)
+	operation := a.newOperation(ActionSymlink)
+
+	for _, decision := range a.decideDuplicateGroups() {
+		keep := decision.keep
+		for _, file := range decision.rest {
+			target, err := symlinkTarget(keep.Path, file.Path, relative)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error linking %s: %v\n", file.Path, err)
+				continue
+			}
+
+			if a.config.DryRun {
+				fmt.Printf("Would symlink %s to %s\n", file.Path, target)
+				continue
+			}
+
+			if err := a.symlinkFile(keep, file, target); err != nil {
+				fmt.Fprintf(os.Stderr, "Error linking %s: %v\n", file.Path, err)
+				continue
+			}
+			operation.record(file, file.Path, keep.Path)
+
+			if err := a.index.ReplacedByLink(file, keep, target); err != nil {
+				fmt.Fprintf(os.Stderr, "Error updating database for %s: %v\n", file.Path, err)
+			}
+
+			linkedCount++
+			savedSize += file.Size
+		}
+	}
+
+	fmt.Printf("Replaced %d duplicate files with symbolic links, %s saved\n", linkedCount, HumanizeBytes(savedSize))
+	operation.finish()
+}
+
+// Lets every duplicate share its data blocks with the kept file of its group (btrfs, XFS).
+// Unlike links the files stay independent, editing one copy later does not change the others.
+func (a *App) ReflinkDuplicateFiles() {
+	reflinkedCount := 0
+	savedSize := int64(0)
+	operation := a.newOperation(ActionReflink)
+
+	for i, decision := range a.decideDuplicateGroups() {
+		keep := decision.keep
+
+		// collect the files the kernel can share extents with
+		var files []*FileItem
+		var paths []string
+		for _, file := range decision.rest {
+			if err := verifyReflinkable(keep, file); err != nil {
+				fmt.Fprintf(os.Stderr, "Error reflinking %s: %v\n", file.Path, err)
+				continue
+			}
+			files = append(files, file)
+			paths = append(paths, file.Path)
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		if a.config.DryRun {
+			for _, file := range files {
+				fmt.Printf("Would reflink %s to %s\n", file.Path, keep.Path)
+			}
+			continue
+		}
+
+		deduped, err := dedupeFiles(keep.Path, paths, keep.Size)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reflinking group %d (%s): %v\n", i+1, keep.Path, err)
+			continue
+		}
+
+		groupSize := int64(0)
+		for j, file := range files {
+			if deduped[j] < file.Size {
+				fmt.Fprintf(os.Stderr, "Warning: only %s of %s deduplicated, content differs from %s\n",
+					HumanizeBytes(deduped[j]), file.Path, keep.Path)
+			} else {
+				reflinkedCount++
+				operation.record(file, file.Path, keep.Path)
+			}
+			groupSize += deduped[j]
+		}
+		savedSize += groupSize
+		fmt.Printf("Group %d (%s): %s deduplicated in %d files\n", i+1, keep.Path, HumanizeBytes(groupSize), len(files))
+	}
+
+	fmt.Printf("Reflinked %d duplicate files, %s deduplicated\n", reflinkedCount, HumanizeBytes(savedSize))
+	operation.finish()
+}
+
+// Replaces file with a hard link to keep
+func (a *App) hardlinkFile(keep, file *FileItem) error {
+	// hard links can not cross filesystems
+	same, err := sameFilesystem(keep.Path, file.Path)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("%s is on another filesystem", keep.Path)
+	}
+
+	if err := verifyReplaceable(keep, file); err != nil {
+		return err
+	}
+
+	return replaceFile(file.Path, func(tempPath string) error {
+		return os.Link(keep.Path, tempPath)
+	})
+}
+
+// Replaces file with a symbolic link pointing to target
+func (a *App) symlinkFile(keep, file *FileItem, target string) error {
+	if err := verifyReplaceable(keep, file); err != nil {
+		return err
+	}
+
+	return replaceFile(file.Path, func(tempPath string) error {
+		return os.Symlink(target, tempPath)
+	})
+}
+
+// Returns the target of a symbolic link at linkPath pointing to keepPath
+func symlinkTarget(keepPath, linkPath string, relative bool) (string, error) {
+	absKeep, err := filepath.Abs(keepPath)
+	if err != nil {
+		return "", err
+	}
+	if !relative {
+		return absKeep, nil
+	}
+
+	absLink, err := filepath.Abs(linkPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(filepath.Dir(absLink), absKeep)
+}
+
+// Checks that file is a regular file with the same content as keep and no link to it.
+// The index might be outdated, so this gets called right before replacing a file.
+func verifyReplaceable(keep, file *FileItem) error {
+	keepInfo, err := os.Stat(keep.Path)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := os.Lstat(file.Path)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	if os.SameFile(keepInfo, fileInfo) {
+		return fmt.Errorf("already linked to %s", keep.Path)
+	}
+
+	identical, err := CompareFilesBinary(context.Background(), keep.Path, file.Path)
+	if err != nil {
+		return err
+	}
+	if !identical {
+		return fmt.Errorf("content differs from %s", keep.Path)
+	}
+	return nil
+}
+
+// Checks that file is a regular file on the same filesystem as keep and not linked to it.
+// The content is compared by the kernel while deduplicating.
+func verifyReflinkable(keep, file *FileItem) error {
+	keepInfo, err := os.Stat(keep.Path)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := os.Lstat(file.Path)
+	if err != nil {
+		return err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	if os.SameFile(keepInfo, fileInfo) {
+		return fmt.Errorf("already linked to %s", keep.Path)
+	}
+
+	same, err := sameFilesystem(keep.Path, file.Path)
+	if err != nil {
+		return err
+	}
+	if !same {
+		return fmt.Errorf("%s is on another filesystem", keep.Path)
+	}
+	return nil
+}
+
+// Replaces the file at path with whatever create writes to a temporary path in the same directory.
+// The temporary file is renamed over the original, so the original is either replaced
+// completely or left untouched.
+func replaceFile(path string, create func(tempPath string) error) error {
+	tempPath := tempPathFor(path)
+	if err := create(tempPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// Returns a hidden, unused file name in the directory of path
+func tempPathFor(path string) string {
+	return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.df-%d.tmp", filepath.Base(path), time.Now().UnixNano()))
+}
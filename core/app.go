@@ -1,7 +1,9 @@
 package core
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,21 +12,47 @@ import (
 )
 
 type App struct {
-	index  *Index
-	config *Config
+	ctx        context.Context // Cancelled on SIGINT or SIGTERM, long running commands save their results so far and stop
+	index      *Index
+	config     *Config
+	keepPolicy *KeepPolicy
+	roots      []*Root // Read on first use, see getRoots
 }
 
 func NewApp() *App {
-	config := NewConfig()
+	return NewAppWithConfig(NewConfig())
+}
+
+// Creates the app with a configuration that was changed after NewConfig, e.g. by command line flags
+func NewAppWithConfig(config *Config) *App {
+	return NewAppWithContext(context.Background(), config)
+}
+
+// Creates the app with a context that interrupts long running commands, like scans, when it is cancelled
+func NewAppWithContext(ctx context.Context, config *Config) *App {
 	idx, err := NewIndex(config)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error creating database: %v\n", err)
 		os.Exit(1)
 	}
 
+	protectedRoots, err := idx.GetProtectedRoots()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	keepPolicy, err := NewKeepPolicy(config, protectedRoots)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	return &App{
-		index:  idx,
-		config: config,
+		ctx:        ctx,
+		index:      idx,
+		config:     config,
+		keepPolicy: keepPolicy,
 	}
 }
 
@@ -40,67 +68,131 @@ func (a *App) ShowConfig() {
 	fmt.Printf("- DryRun: %v\n", a.config.DryRun)
 	fmt.Printf("- Database file: %s\n", a.index.GetIndexPath())
 	fmt.Printf("- Minimum file size: %d bytes\n", a.config.MinFileSize)
-	fmt.Printf("- Sample size in bytes for binary comparism: %d bytes\n", a.config.SampleSizeBinaryCompare)
+	fmt.Printf("- Verify mode: %s (available: %s)\n", a.config.VerifyMode, strings.Join(VerifyModeNames(), ", "))
+	fmt.Printf("- Sample blocks: %d of %s\n", a.config.SampleBlocks, HumanizeBytes(a.config.SampleBlockSize))
+	fmt.Printf("- Hash algorithm: %s (available: %s)\n", a.index.hasher.Name(), strings.Join(HasherNames(), ", "))
+	fmt.Printf("- Lockstep comparison: size groups of up to %d files\n", a.config.LockstepMaxFiles)
+	fmt.Printf("- Partial hash size: %d bytes (tail: %v)\n", a.config.PartialHashSize, a.config.PartialHashTail)
 	fmt.Printf("- Database path: %s\n", a.config.DBFilename)
+	fmt.Printf("- Config file: %s\n", a.config.ConfigFilename)
+	fmt.Printf("- Global ignore file: %s\n", a.config.IgnoreFilename)
+	fmt.Printf("- Walk workers: %d\n", a.config.WalkWorkers)
+	fmt.Printf("- Hashing workers per device: %d (HDD), %d (SSD)\n", a.config.HDDWorkers, a.config.SSDWorkers)
+	fmt.Printf("- Keep rules: %s (available: %s)\n", a.keepPolicy, strings.Join(KeepRuleNames(), ", "))
+	fmt.Printf("- Preferred directories: %s\n", strings.Join(a.config.KeepPreferDirs, ", "))
+	fmt.Printf("- Never touch: %s\n", strings.Join(a.config.KeepNeverTouch, ", "))
+	fmt.Printf("- Protected roots: %s\n", strings.Join(a.keepPolicy.ProtectedRoots(), ", "))
 	fmt.Printf("- System trash directory: %s\n", GetTrashPath())
 }
 
 func (a *App) ShowFiles() {
-	files := a.index.GetAllFiles()
-	if len(files) == 0 {
+	// files are printed while they are read, the index does not have to fit into memory
+	count := 0
+	err := a.index.ForEachFile(func(file *FileItem) error {
+		fmt.Println(file.Path)
+		count++
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if count == 0 {
 		fmt.Println("No files in database")
 		return
 	}
-	// show each file path
-	for _, file := range files {
-		fmt.Println(file.Path)
-	}
 	// show totals
-	fmt.Printf("Files in database: %d total.\n", len(files))
+	fmt.Printf("Files in database: %d total.\n", count)
 }
 
 func (a *App) ShowDupes() {
-	files := a.index.GetAllDupes()
-	if len(files) == 0 {
+	// files are printed while they are read, the index does not have to fit into memory
+	count := 0
+	err := a.index.ForEachDupe(func(file *FileItem) error {
+		fmt.Println(file.Path)
+		count++
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if count == 0 {
 		fmt.Println("No duplicate files in database")
 		return
 	}
-	// show each file path
-	for _, file := range files {
-		fmt.Println(file.Path)
-	}
 	// show totals
-	fmt.Printf("Duplicate files in database: %d total.\n", len(files))
+	fmt.Printf("Duplicate files in database: %d total.\n", count)
 }
 
 func (a *App) ShowHashes() {
-	files := a.index.GetAllHashedFiles()
-	if len(files) == 0 {
+	// files are printed while they are read, the index does not have to fit into memory
+	count := 0
+	err := a.index.ForEachHashedFile(func(file *FileItem) error {
+		fmt.Println(file.Path)
+		count++
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if count == 0 {
 		fmt.Println("No hashed files in database")
 		return
 	}
-	// show each file hash
-	for _, file := range files {
-		fmt.Println(file.Path)
-	}
 	// show totals
-	fmt.Printf("Hashed files in database: %d total.\n", len(files))
+	fmt.Printf("Hashed files in database: %d total.\n", count)
 }
 
 func (a *App) StartScan() {
 
 	// No files in FileIndex skip
-	files := a.index.GetAllFiles()
-	if len(files) == 0 {
+	count, err := a.index.CountFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if count == 0 {
 		fmt.Println("No files in database. Nothing to scan.")
 		return
 	}
 
+	a.runScan(NewScanner(a.ctx, a.index))
+}
+
+// Continues the last scan session if it was interrupted
+func (a *App) ResumeScan() {
+	session, err := a.index.GetInterruptedScanSession()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if session == nil {
+		fmt.Println("No interrupted scan session to resume.")
+		return
+	}
+
+	scanner := NewScanner(a.ctx, a.index)
+	if err := scanner.ResumeSession(session); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Resuming scan session %d from %s, groups found before the interruption are kept\n",
+		session.SessionID, time.Unix(session.StartedAt, 0).Format("2006-01-02 15:04:05"))
+	a.runScan(scanner)
+}
+
+// Runs the scan and prints the found groups
+func (a *App) runScan(scanner *Scanner) {
 	// Start
 	start := time.Now()
-	scanner := NewScanner(a.index)              // Create scanner instance
 	results, err := scanner.ScanForDuplicates() // Call method on scanner
 
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Scan session %d interrupted, the hashes calculated so far are saved. Continue with --resume\n", scanner.SessionID())
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
@@ -114,15 +206,17 @@ func (a *App) StartScan() {
 
 	// Print results
 	if len(results) == 0 {
-		fmt.Println("No duplicate files found!\n")
+		fmt.Println("No duplicate files found!")
 	} else {
 		fmt.Printf("Found %d group(s) of duplicate files:\n", len(results))
 
 		totalDuplicateSize := int64(0)
 		totalDuplicateFiles := 0
+		methodGroups := make(map[string]int)
 
 		for i, result := range results {
-			fmt.Printf("\nGroup %d (Hash: %s):\n", i+1, result.HashSum)
+			methodGroups[result.Method]++
+			fmt.Printf("\nGroup %d (Hash: %s %s, verified: %s):\n", i+1, result.HashAlgorithm, result.HashSum, result.Method)
 			groupSize := int64(0)
 			var firstFile *FileItem
 
@@ -145,7 +239,15 @@ func (a *App) StartScan() {
 		// Summary
 		fmt.Printf("\nSummary: %d duplicate file(s) in %d group(s), %s used space\n",
 			totalDuplicateFiles, len(results), HumanizeBytes(totalDuplicateSize))
+		var methods []string
+		for _, method := range VerifyModeNames() {
+			if methodGroups[method] > 0 {
+				methods = append(methods, fmt.Sprintf("%d %s", methodGroups[method], method))
+			}
+		}
+		fmt.Printf("Verification (verify mode %s): %s\n", a.config.VerifyMode, strings.Join(methods, ", "))
 	}
+	fmt.Printf("Scan session %d recorded, compare scans with --scan-diff\n", scanner.SessionID())
 }
 
 func (a *App) IndexPurge() {
@@ -166,58 +268,127 @@ func (a *App) IndexUpdate() {
 	fmt.Printf("Updated %d files in the database\n", count)
 }
 
-func (a *App) AddPathToIndex(path string, recursive bool, filter string) {
+// Adds a file or directory to the index. Directories are recorded as roots, so --rescan-roots walks them again.
+// Files that are indexed already and did not change keep their hashes.
+func (a *App) AddPathToIndex(path string, recursive bool, filter *Filter) {
 	if path == "" {
 		fmt.Fprintf(os.Stderr, "Error: No path specified\n")
 		os.Exit(1)
 	}
 
-	// remember  current amount of indexed files
-	currentCount := len(a.index.GetAllFiles())
-
-	// add directory or file
-	fileItems, err := a.getFileInfos(path, recursive, filter)
+	info, err := os.Stat(path)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	err = a.index.AddFileItems(fileItems)
 
-	// remember new amount of indexed files
-	newCount := len(a.index.GetAllFiles())
-	// display changed files
-	fmt.Printf("Updated %d files\n", newCount-currentCount)
+	if info.IsDir() {
+		root, err := a.saveRoot(path, "", recursive, filter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		added, _, err := a.indexRoot(root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Updated %d files\n", added)
+		return
+	}
 
+	absPath, err := filepath.Abs(path)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
+	added, err := a.indexWalk(absPath, recursive, filter, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Updated %d files\n", added)
+}
+
+// Walks the path with the parallel walker and writes new and changed files to the index while walking.
+// The guids of all found files are added to walked, if it is not nil. Returns the number of written files.
+func (a *App) indexWalk(path string, recursive bool, filter *Filter, walked map[string]bool) (int, error) {
+	added := 0
+	err := a.newWalker(path, recursive, filter).walk(func(batch []*FileItem) error {
+		// the batches written so far stay in the index
+		if err := a.ctx.Err(); err != nil {
+			return err
+		}
+		if walked != nil {
+			for _, file := range batch {
+				walked[file.Guid] = true
+			}
+		}
+		changed, err := a.index.changedFileItems(batch)
+		if err != nil {
+			return err
+		}
+		if err := a.index.AddFileItems(changed); err != nil {
+			return err
+		}
+		added += len(changed)
+		return nil
+	})
+	return added, err
 }
 
-func (a *App) getFileInfos(dirPath string, recursive bool, filter string) ([]*FileItem, error) {
+// Walks the directory with filepath.Walk and returns the files the filter and the ignore files let through.
+// Excluded and ignored directories are not walked. Indexing uses the parallel walker, this sequential walk
+// is the baseline of --benchmark-walk.
+func (a *App) getFileInfos(dirPath string, recursive bool, filter *Filter) ([]*FileItem, error) {
 	var fileItems []*FileItem
-	minFileSize := a.index.config.MinFileSize
+
+	// a single file is checked by its name
+	base := dirPath
+	if info, err := os.Stat(dirPath); err == nil && !info.IsDir() {
+		base = filepath.Dir(dirPath)
+	}
+	ignore := newIgnoreTracker(base, a.config.IgnoreFilename)
 
 	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Skip errors
 		}
-		if info.IsDir() {
-			if !recursive && path != dirPath {
-				return filepath.SkipDir
-			}
+		relPath, err := filepath.Rel(base, path)
+		if err != nil {
 			return nil
 		}
 
-		// Filter check
-		if filter != "" {
-			if matched, _ := filepath.Match(filter, filepath.Base(path)); !matched {
+		if info.IsDir() {
+			if path == dirPath {
+				ignore.ignored(path, true) // reads the .dfignore of the walked directory
 				return nil
 			}
+			if !recursive {
+				return filepath.SkipDir
+			}
+			if walked, reason := filter.MatchDir(relPath); !walked {
+				if a.config.Debug {
+					fmt.Printf("Debug: Skipping directory %s, %s\n", path, reason)
+				}
+				return filepath.SkipDir
+			}
+			if rule := ignore.ignored(path, true); rule != nil {
+				if a.config.Debug {
+					fmt.Printf("Debug: Skipping directory %s, ignored by %s\n", path, rule.source)
+				}
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
-		// Size check
-		if minFileSize > 0 && info.Size() < minFileSize {
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		if ignore.ignored(path, false) != nil {
+			return nil
+		}
+		if included, _ := filter.MatchFile(relPath, info.Size(), info.ModTime().Unix()); !included {
 			return nil
 		}
 
@@ -252,8 +423,12 @@ func (a *App) RemovePathFromIndex(path string) {
 		os.Exit(1)
 	}
 
-	// Normalize path for comparison
-	normalizedPath := filepath.Clean(path)
+	// Normalize path for comparison, files are added with absolute paths
+	normalizedPath, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	// Begin transaction
 	tx, err := a.index.db.Begin()
@@ -291,19 +466,85 @@ func (a *App) RemovePathFromIndex(path string) {
 		os.Exit(1)
 	}
 
-	// Remove from in-memory index
-	removedFromMemory := 0
-	for guid, file := range a.index.files {
-		if file.Path == normalizedPath || strings.HasPrefix(file.Path, normalizedPath+string(filepath.Separator)) {
-			delete(a.index.files, guid)
-			removedFromMemory++
-		}
+	// a removed root would add the files again on --rescan-roots
+	if removed, err := a.index.RemoveRoot(normalizedPath); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	} else if removed {
+		fmt.Printf("Removed root %s\n", normalizedPath)
 	}
 
 	fmt.Printf("Removed %d files from database\n", rowsAffected)
 }
 
+// Protects a directory, files under it are always kept and never moved, trashed or replaced
+func (a *App) ProtectPath(path string) {
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "Error: No path specified\n")
+		os.Exit(1)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := a.index.AddProtectedRoot(absPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Protected %s\n", absPath)
+}
+
+func (a *App) UnprotectPath(path string) {
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "Error: No path specified\n")
+		os.Exit(1)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	removed, err := a.index.RemoveProtectedRoot(absPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !removed {
+		fmt.Printf("%s is not a protected root in the database\n", absPath)
+		return
+	}
+	fmt.Printf("Removed protection of %s\n", absPath)
+}
+
+func (a *App) ShowProtectedRoots() {
+	roots := a.keepPolicy.ProtectedRoots()
+	if len(roots) == 0 {
+		fmt.Println("No protected roots")
+		return
+	}
+	for _, root := range roots {
+		fmt.Println(root)
+	}
+	fmt.Printf("Protected roots: %d total.\n", len(roots))
+}
+
 func (a *App) MoveDuplicateFilesToDirectory(path string) {
+	a.moveDuplicateFiles(a.decideDuplicateGroups(), path, ActionMove, false)
+}
+
+// Moves the duplicates to the directory, keeping their directory structure below it.
+// A manifest in the directory lists the original path and the kept copy of every moved file.
+func (a *App) MoveDuplicateFilesMirrored(path string) {
+	a.moveDuplicateFiles(a.decideDuplicateGroups(), path, ActionMove, true)
+}
+
+// Moves the files of each decision to the directory and records them in the journal under the given action.
+// With mirror set the path of each file is recreated below the directory, otherwise all files are put into it directly.
+func (a *App) moveDuplicateFiles(decisions []keepDecision, path string, action string, mirror bool) {
 	if path == "" {
 		fmt.Fprintf(os.Stderr, "Error: No path specified\n")
 		os.Exit(1)
@@ -320,70 +561,94 @@ func (a *App) MoveDuplicateFilesToDirectory(path string) {
 		os.Exit(1)
 	}
 
-	// move files to directory - only duplicates, keeping the first file of each size+hash group
-	files := a.index.GetRestOfDuplicates()
-	movedCount := 0
-
-	for _, file := range files {
-		// Get the base filename from the original path
-		baseFileName := filepath.Base(file.Path)
-		// Create the destination path by joining the target directory with the filename
-		destPath := filepath.Join(path, baseFileName)
-
-		// Check if destination file already exists
-		if _, err := os.Stat(destPath); err == nil {
-			// File exists, create a unique name
-			ext := filepath.Ext(baseFileName)
-			name := baseFileName[:len(baseFileName)-len(ext)]
-			destPath = filepath.Join(path, fmt.Sprintf("%s_%d%s", name, time.Now().UnixNano(), ext))
+	var manifest *moveManifest
+	if mirror && !a.config.DryRun {
+		manifest, err = newMoveManifest(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
+		defer manifest.close()
+	}
 
-		if a.config.DryRun {
-			fmt.Printf("Would move %s to %s\n", file.Path, destPath)
-		}
+	movedCount := 0
+	operation := a.newOperation(action)
+
+	// move files to directory - only duplicates, the keep policy decides which file of each group stays
+	for _, decision := range decisions {
+		for _, file := range decision.rest {
+			var destPath string
+			if mirror {
+				destPath, err = mirrorDestination(path, file, a.rootFor(file.Path))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error moving %s: %v\n", file.Path, err)
+					continue
+				}
+			} else {
+				destPath = flatDestination(path, file)
+			}
 
-		if !a.config.DryRun {
+			if a.config.DryRun {
+				fmt.Printf("Would move %s to %s\n", file.Path, destPath)
+				continue
+			}
 
-			// Todo: invalid cross-device link
+			if mirror {
+				if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+					fmt.Fprintf(os.Stderr, "Error moving %s: %v\n", file.Path, err)
+					continue
+				}
+			}
 
-			err = os.Rename(file.Path, destPath)
+			err = moveFile(file.Path, destPath, file.Hash, file.HashAlgorithm)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error moving %s: %v\n", file.Path, err)
 				continue
 			}
 
-			// Update the file path in the database
-			oldGuid := file.Guid
-			file.Path = destPath
-			file.Guid = filepath.Clean(destPath)
+			operation.record(file, file.Path, destPath)
+			if manifest != nil {
+				if err := manifest.add(destPath, file.Path, decision.keep.Path); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+				}
+			}
 
-			// Update the database
-			_, err = a.index.db.Exec(
-				"UPDATE files SET path = ?, guid = ? WHERE guid = ?",
-				file.Path, file.Guid, oldGuid,
-			)
+			// Update the file path in the database, trashed files are no longer indexed
+			if action == ActionTrash {
+				_, err = a.index.RemoveFiles([]string{file.Guid})
+			} else {
+				err = a.index.UpdateFilePath(file, destPath)
+			}
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error updating database for %s: %v\n", file.Path, err)
+				fmt.Fprintf(os.Stderr, "Error updating database for %s: %v\n", destPath, err)
 			}
 
-			// Update the in-memory index
-			delete(a.index.files, oldGuid)
-			a.index.files[file.Guid] = file
-
 			movedCount++
-
 		}
-
 	}
 
 	fmt.Printf("Moved %d duplicate files to %s\n", movedCount, path)
+	if manifest != nil && manifest.count > 0 {
+		fmt.Printf("Manifest written to %s\n", manifest.path)
+	}
+	operation.finish()
 }
 
 func (a *App) MoveDuplicateFilesToTrash() {
+	a.trashDuplicates(a.decideDuplicateGroups())
+}
+
+// Moves the files of each decision to the trash
+func (a *App) trashDuplicates(decisions []keepDecision) {
+	if freeDesktopTrash {
+		a.trashDuplicateFiles(decisions)
+		return
+	}
+
 	// Get OS specific path of trash directory
 	trashpath := GetTrashPath()
 	// Move duplicate files
-	a.MoveDuplicateFilesToDirectory(trashpath)
+	a.moveDuplicateFiles(decisions, trashpath, ActionTrash, false)
 }
 
 // Delete from duplicate table
@@ -436,12 +701,5 @@ func (a *App) IndexClear() {
 		os.Exit(1)
 	}
 
-	// Remove from in-memory index
-	removedFromMemory := 0
-	for guid := range a.index.files {
-		delete(a.index.files, guid)
-		removedFromMemory++
-	}
-
 	fmt.Printf("Removed %d files from database\n", rowsAffected)
 }
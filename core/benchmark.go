@@ -0,0 +1,295 @@
+package core
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Size of the tree --benchmark-walk generates
+const (
+	benchmarkDirFanout = 10 // Subdirectories per directory
+	benchmarkDirDepth  = 3  // Levels of subdirectories
+	benchmarkFilesDir  = 20 // Files per directory
+
+	benchmarkGroups    = 300        // Size groups of the --benchmark-lockstep files
+	benchmarkGroupSize = 256 * 1024 // Size of the smallest files of --benchmark-lockstep
+)
+
+// Compares the sequential walk with the parallel walker. Both write the found files into their own temporary
+// database, the results must be the same. Without a directory a tree of about 22,000 files is generated.
+func (a *App) BenchmarkWalk(dir string) {
+	tmpDir, err := os.MkdirTemp("", "dupefiles-benchmark-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if dir == "" {
+		dir = filepath.Join(tmpDir, "tree")
+		start := time.Now()
+		count, err := generateBenchmarkTree(dir, benchmarkDirDepth)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating tree: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Generated %d files in %s\n", count, time.Since(start).Round(time.Millisecond))
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// every file counts, the filter of the index does not matter here
+	filter := &Filter{}
+
+	// the first walk fills the file system cache, so both timed walks read from it
+	if _, err := a.getFileInfos(dir, true, filter); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	sequential := a.benchmarkApp(filepath.Join(tmpDir, "sequential.db"))
+	defer sequential.index.Close()
+	start := time.Now()
+	fileItems, err := sequential.getFileInfos(dir, true, filter)
+	if err == nil {
+		err = sequential.index.AddFileItems(fileItems)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	sequentialTime := time.Since(start)
+	sequentialFiles := sequential.benchmarkFiles()
+	fmt.Printf("Sequential walk: %d files in %s\n", len(sequentialFiles), sequentialTime.Round(time.Millisecond))
+
+	parallel := a.benchmarkApp(filepath.Join(tmpDir, "parallel.db"))
+	defer parallel.index.Close()
+	start = time.Now()
+	if _, err := parallel.indexWalk(dir, true, filter, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	parallelTime := time.Since(start)
+	parallelFiles := parallel.benchmarkFiles()
+	fmt.Printf("Parallel walk (%d workers): %d files in %s\n", a.config.WalkWorkers, len(parallelFiles), parallelTime.Round(time.Millisecond))
+
+	if differences := compareFileItems(sequentialFiles, parallelFiles); differences > 0 {
+		fmt.Fprintf(os.Stderr, "Error: The walks found %d different files\n", differences)
+		os.Exit(1)
+	}
+	fmt.Printf("Both walks found the same files, the parallel walk took %.2fx the time of the sequential walk\n",
+		parallelTime.Seconds()/sequentialTime.Seconds())
+}
+
+// Returns an app with its own index in the database file, with the configuration of a
+func (a *App) benchmarkApp(dbFilename string) *App {
+	config := *a.config
+	config.DBFilename = dbFilename
+	config.IgnoreFilename = ""
+	idx, err := NewIndex(&config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating database: %v\n", err)
+		os.Exit(1)
+	}
+	return &App{ctx: a.ctx, index: idx, config: &config, keepPolicy: a.keepPolicy}
+}
+
+// Returns all files of the index by guid, for the comparison of the walks
+func (a *App) benchmarkFiles() map[string]*FileItem {
+	files := make(map[string]*FileItem)
+	err := a.index.ForEachFile(func(file *FileItem) error {
+		files[file.Guid] = file
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return files
+}
+
+// Creates directories with files of random sizes, depth levels deep. Returns the number of files.
+func generateBenchmarkTree(dir string, depth int) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := range benchmarkFilesDir {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("file%02d.dat", i)))
+		if err != nil {
+			return count, err
+		}
+		// sparse files, only the size matters for the walk
+		err = f.Truncate(rand.Int64N(1 << 20))
+		f.Close()
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if depth == 0 {
+		return count, nil
+	}
+	for i := range benchmarkDirFanout {
+		n, err := generateBenchmarkTree(filepath.Join(dir, fmt.Sprintf("dir%02d", i)), depth-1)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// Returns the number of files that are missing in one of the maps or differ
+func compareFileItems(a, b map[string]*FileItem) int {
+	differences := 0
+	for guid, fileA := range a {
+		fileB, ok := b[guid]
+		if !ok || fileA.Path != fileB.Path || fileA.Extension != fileB.Extension || fileA.Size != fileB.Size ||
+			fileA.ModTime != fileB.ModTime || fileA.HumanizedSize != fileB.HumanizedSize {
+			differences++
+		}
+	}
+	for guid := range b {
+		if _, ok := a[guid]; !ok {
+			differences++
+		}
+	}
+	return differences
+}
+
+// Compares the lockstep comparison with hashing and verifying afterwards. Both scan the same files in their own
+// temporary database, the groups they find must be the same. Without a directory about 300 groups of two
+// or three files are generated, a third of them identical, a third different in the first and a third
+// in the last block.
+func (a *App) BenchmarkLockstep(dir string) {
+	tmpDir, err := os.MkdirTemp("", "dupefiles-benchmark-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if dir == "" {
+		dir = filepath.Join(tmpDir, "groups")
+		start := time.Now()
+		count, err := generateBenchmarkGroups(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating files: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Generated %d files in %s\n", count, time.Since(start).Round(time.Millisecond))
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// the first scan fills the file system cache, so both timed scans read from it
+	warmUp := a.benchmarkScanApp(filepath.Join(tmpDir, "warmup.db"), dir, 0)
+	warmUp.benchmarkScan()
+	warmUp.index.Close()
+
+	hashed := a.benchmarkScanApp(filepath.Join(tmpDir, "hashed.db"), dir, 0)
+	defer hashed.index.Close()
+	hashedGroups, hashedTime := hashed.benchmarkScan()
+
+	lockstep := a.benchmarkScanApp(filepath.Join(tmpDir, "lockstep.db"), dir, max(a.config.LockstepMaxFiles, DefaultLockstepMaxFiles))
+	defer lockstep.index.Close()
+	lockstepGroups, lockstepTime := lockstep.benchmarkScan()
+
+	fmt.Printf("Hash and verify: %d groups in %s\n", len(hashedGroups), hashedTime.Round(time.Millisecond))
+	fmt.Printf("Lockstep (groups of up to %d files): %d groups in %s\n", lockstep.config.LockstepMaxFiles, len(lockstepGroups), lockstepTime.Round(time.Millisecond))
+
+	differences := 0
+	for group := range hashedGroups {
+		if !lockstepGroups[group] {
+			differences++
+		}
+	}
+	for group := range lockstepGroups {
+		if !hashedGroups[group] {
+			differences++
+		}
+	}
+	if differences > 0 {
+		fmt.Fprintf(os.Stderr, "Error: The scans found %d different groups\n", differences)
+		os.Exit(1)
+	}
+	fmt.Printf("Both scans found the same groups, the lockstep comparison took %.2fx the time of hashing\n",
+		lockstepTime.Seconds()/hashedTime.Seconds())
+}
+
+// Returns an app with the files of dir in its own index, comparing size groups of up to lockstepMaxFiles
+// files in lockstep
+func (a *App) benchmarkScanApp(dbFilename, dir string, lockstepMaxFiles int) *App {
+	app := a.benchmarkApp(dbFilename)
+	app.config.LockstepMaxFiles = lockstepMaxFiles
+	app.config.MinFileSize = 0
+	if _, err := app.indexWalk(dir, true, &Filter{}, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return app
+}
+
+// Scans the index and returns the found groups, as their sorted guids, and the time the scan took
+func (a *App) benchmarkScan() (map[string]bool, time.Duration) {
+	start := time.Now()
+	results, err := NewScanner(a.ctx, a.index).ScanForDuplicates()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	duration := time.Since(start)
+
+	groups := make(map[string]bool)
+	for _, result := range results {
+		guids := slices.Clone(result.FileGuids)
+		slices.Sort(guids)
+		groups[strings.Join(guids, "\n")] = true
+	}
+	return groups, duration
+}
+
+// Creates benchmarkGroups groups of two or three files with random content and a size of their own.
+// Returns the number of files.
+func generateBenchmarkGroups(dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := range benchmarkGroups {
+		size := benchmarkGroupSize + int64(i)*4096
+		content := make([]byte, size)
+		rand.NewChaCha8([32]byte{byte(i), byte(i >> 8)}).Read(content)
+
+		for j := range 2 + i%2 {
+			switch {
+			case j == 0 || i%3 == 0:
+				// identical copies
+			case i%3 == 1:
+				content[0]++ // differs in the first block
+			default:
+				content[size-1]++ // differs in the last block
+			}
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("group%03d-%d.dat", i, j)), content, 0644); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
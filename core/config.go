@@ -1,62 +1,190 @@
 package core
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 )
 
 const DefaultIndexFilename = "dupefiles.db"
+const DefaultConfigFilename = "dupefiles.conf"
 
 // Config holds application configuration
 type Config struct {
-	Debug                   bool   // Show debug information
-	DryRun                  bool   // Relevant for moving, trashing files. Set to true, only a simulation will follow. No files will get touched.
-	MinFileSize             int64  // Minimum file size in bytes
-	DBFilename              string // Database filename
-	SampleSizeBinaryCompare int    // Sample size for binary comparison. If 0 always the whole file gets compared. If > 0 only this amount of bytes get compared. The bytes are picked randomly across the whole file.
+	Debug            bool     // Show debug information
+	DryRun           bool     // Relevant for moving, trashing files. Set to true, only a simulation will follow. No files will get touched.
+	MinFileSize      int64    // Minimum file size in bytes
+	DBFilename       string   // Database filename
+	VerifyMode       string   // How the files of a hash group are compared, see VerifyModeNames
+	SampleBlockSize  int64    // Size of the blocks compared by the sample verify mode
+	SampleBlocks     int      // Number of blocks compared by the sample verify mode, the first and the last block are always among them
+	LockstepMaxFiles int      // Size groups of up to this many files are compared in lockstep instead of hashed. If 0 all groups are hashed.
+	PartialHashSize  int64    // Bytes hashed from the head of each file before the full hash. If 0 the partial hash stage is skipped.
+	PartialHashTail  bool     // Also hash the same amount of bytes from the tail of each file in the partial hash stage.
+	HashAlgorithm    string   // Hash algorithm used for all file hashes (md5, sha1, sha256, xxh3, blake3)
+	KeepRules        []string // Ordered rules that decide which copy of a duplicate group is kept, see KeepRuleNames
+	KeepPreferDirs   []string // Directories whose files are kept first by the prefer rule
+	KeepNeverTouch   []string // Glob patterns of files that are always kept
+	ProtectedRoots   []string // Directories whose files are never modified, in addition to the protected roots in the index
+	ConfigFilename   string   // Config file the settings were read from
+	IgnoreFilename   string   // Global ignore file, its rules apply to every walked directory in addition to the .dfignore files
+	HDDWorkers       int      // Number of files hashed or compared at the same time on a spinning disk
+	SSDWorkers       int      // Number of files hashed or compared at the same time on an SSD, NVMe, network or unknown device
+	WalkWorkers      int      // Number of directories read at the same time when adding files
 }
 
-// NewConfig creates a new configuration with default values and environment variable overrides
+// NewConfig creates a new configuration with default values, config file and environment variable overrides.
+// The config file uses the names of the environment variables, one KEY=value per line.
 func NewConfig() *Config {
 	config := &Config{
-		Debug:                   false,
-		DryRun:                  false,
-		MinFileSize:             1024,                      // default minimum file size
-		DBFilename:              GetDefaultIndexFilename(), // default database filename
-		SampleSizeBinaryCompare: 0,
+		Debug:            false,
+		DryRun:           false,
+		MinFileSize:      1024,                      // default minimum file size
+		DBFilename:       GetDefaultIndexFilename(), // default database filename
+		VerifyMode:       VerifyFull,
+		SampleBlockSize:  DefaultSampleBlockSize,
+		SampleBlocks:     DefaultSampleBlocks,
+		LockstepMaxFiles: DefaultLockstepMaxFiles,
+		PartialHashSize:  DefaultPartialHashSize,
+		PartialHashTail:  false,
+		HashAlgorithm:    DefaultHashAlgorithm,
+		ConfigFilename:   GetDefaultConfigFilename(),
+		IgnoreFilename:   GetDefaultIgnoreFilename(),
+		HDDWorkers:       DefaultHDDWorkers,
+		SSDWorkers:       DefaultSSDWorkers(),
+		WalkWorkers:      DefaultWalkWorkers(),
+	}
+
+	// Read config filename from environment variable
+	if envConfigFile := os.Getenv("DF_CONFIG"); envConfigFile != "" {
+		config.ConfigFilename = envConfigFile
+	}
+
+	// Environment variables override the config file
+	fileSettings, err := loadConfigFile(config.ConfigFilename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to read config file %s: %v\n", config.ConfigFilename, err)
+	}
+	getenv := func(key string) string {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+		return fileSettings[key]
 	}
 
 	// Read Debug
-	if os.Getenv("DF_DEBUG") == "true" {
+	if getenv("DF_DEBUG") == "true" {
 		config.Debug = true
 	}
 
 	// Read DryRun
-	if os.Getenv("DF_DRYRUN") == "true" {
+	if getenv("DF_DRYRUN") == "true" {
 		config.DryRun = true
 	}
 
 	// Read minimum file size from environment variable
-	if envMinSize := os.Getenv("DF_MINSIZE"); envMinSize != "" {
-		if parsed, err := strconv.ParseInt(envMinSize, 10, 64); err == nil {
+	if envMinSize := getenv("DF_MINSIZE"); envMinSize != "" {
+		if parsed, err := ParseBytes(envMinSize); err == nil {
 			config.MinFileSize = parsed
 		}
 	}
 
 	// Read database filename from environment variable
-	if envDBFile := os.Getenv("DF_DBFILE"); envDBFile != "" {
+	if envDBFile := getenv("DF_DBFILE"); envDBFile != "" {
 		config.DBFilename = envDBFile
 	}
 
-	// Read SampleSizeBinaryCompare
-	if envBCS := os.Getenv("DF_BINARY_COMPARE_SIZE"); envBCS != "" {
-		if parsed, err := strconv.Atoi(envBCS); err == nil {
-			config.SampleSizeBinaryCompare = parsed
+	// Read sample block size and count
+	if envBlockSize := getenv("DF_SAMPLE_BLOCK_SIZE"); envBlockSize != "" {
+		if parsed, err := ParseBytes(envBlockSize); err == nil && parsed > 0 {
+			config.SampleBlockSize = parsed
+		}
+	}
+	if envBlocks := getenv("DF_SAMPLE_BLOCKS"); envBlocks != "" {
+		if parsed, err := strconv.Atoi(envBlocks); err == nil && parsed > 0 {
+			config.SampleBlocks = parsed
+		}
+	}
+
+	// Read verify mode. DF_BINARY_COMPARE_SIZE of older versions selects sampling of about the same amount of bytes.
+	if envBCS := getenv("DF_BINARY_COMPARE_SIZE"); envBCS != "" {
+		if parsed, err := strconv.ParseInt(envBCS, 10, 64); err == nil && parsed > 0 {
+			config.VerifyMode = VerifySample
+			config.SampleBlocks = int(max(2, (parsed+config.SampleBlockSize-1)/config.SampleBlockSize))
+		}
+	}
+	if envVerify := getenv("DF_VERIFY"); envVerify != "" {
+		config.VerifyMode = envVerify
+	}
+
+	// Read the largest size group compared in lockstep
+	if envLockstep := getenv("DF_LOCKSTEP_MAX_FILES"); envLockstep != "" {
+		if parsed, err := strconv.Atoi(envLockstep); err == nil && parsed >= 0 {
+			config.LockstepMaxFiles = parsed
+		}
+	}
+
+	// Read partial hash size
+	if envPartialSize := getenv("DF_PARTIAL_SIZE"); envPartialSize != "" {
+		if parsed, err := strconv.ParseInt(envPartialSize, 10, 64); err == nil {
+			config.PartialHashSize = parsed
+		}
+	}
+
+	// Read partial hash tail
+	if getenv("DF_PARTIAL_TAIL") == "true" {
+		config.PartialHashTail = true
+	}
+
+	// Read hash algorithm
+	if envHash := getenv("DF_HASH"); envHash != "" {
+		config.HashAlgorithm = envHash
+	}
+
+	// Read keep rules
+	if envKeep := getenv("DF_KEEP"); envKeep != "" {
+		config.KeepRules = SplitList(envKeep)
+	}
+	if envKeepPrefer := getenv("DF_KEEP_PREFER"); envKeepPrefer != "" {
+		config.KeepPreferDirs = SplitList(envKeepPrefer)
+	}
+	if envNeverTouch := getenv("DF_NEVER_TOUCH"); envNeverTouch != "" {
+		config.KeepNeverTouch = SplitList(envNeverTouch)
+	}
+
+	// Read global ignore file
+	if envIgnore := getenv("DF_IGNORE"); envIgnore != "" {
+		config.IgnoreFilename = envIgnore
+	}
+
+	// Read number of walk workers
+	if envWorkers := getenv("DF_WALK_WORKERS"); envWorkers != "" {
+		if parsed, err := strconv.Atoi(envWorkers); err == nil && parsed > 0 {
+			config.WalkWorkers = parsed
+		}
+	}
+
+	// Read number of hashing workers per device
+	if envHDD := getenv("DF_HDD_WORKERS"); envHDD != "" {
+		if parsed, err := strconv.Atoi(envHDD); err == nil && parsed > 0 {
+			config.HDDWorkers = parsed
+		}
+	}
+	if envSSD := getenv("DF_SSD_WORKERS"); envSSD != "" {
+		if parsed, err := strconv.Atoi(envSSD); err == nil && parsed > 0 {
+			config.SSDWorkers = parsed
 		}
 	}
 
+	// Read protected roots
+	if envProtected := getenv("DF_PROTECTED"); envProtected != "" {
+		config.ProtectedRoots = SplitList(envProtected)
+	}
+
 	if config.Debug {
 		fmt.Println("Configuration loaded from environment variables. Debug is on.")
 	}
@@ -64,6 +192,69 @@ func NewConfig() *Config {
 	return config
 }
 
+// Splits a comma separated setting and drops empty entries
+func SplitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Reads KEY=value lines from the config file. Empty lines and lines starting with # are ignored.
+// A missing config file is no error.
+func loadConfigFile(filename string) (map[string]string, error) {
+	settings := make(map[string]string)
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		settings[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+
+	return settings, scanner.Err()
+}
+
+func GetDefaultConfigFilename() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return DefaultConfigFilename
+	}
+	return filepath.Join(homeDir, ".config", "dupefiles", DefaultConfigFilename)
+}
+
+// Returns the default number of walk workers. Reading directories mostly waits for the disk or network,
+// so there are more workers than CPUs.
+func DefaultWalkWorkers() int {
+	return max(4, 2*runtime.NumCPU())
+}
+
+func GetDefaultIgnoreFilename() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".config", "dupefiles", "ignore")
+}
+
 func GetDefaultIndexFilename() string {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
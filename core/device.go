@@ -0,0 +1,138 @@
+package core
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+const DefaultHDDWorkers = 1
+
+// Returns the default number of files read at the same time from an SSD, NVMe or network device
+func DefaultSSDWorkers() int {
+	return runtime.NumCPU()
+}
+
+// Identifies a file on its device, all hard links to a file share it
+type fileKey struct {
+	dev uint64
+	ino uint64
+}
+
+// A device files are read from. Spinning disks get few workers, so they do not seek between files all the time.
+type ioDevice struct {
+	id         uint64
+	rotational bool
+	workers    int
+	slots      chan struct{} // One slot per worker, shared by all runs. A job holds a slot while it reads from the device.
+}
+
+func (d *ioDevice) String() string {
+	kind := "ssd"
+	if d.rotational {
+		kind = "hdd"
+	}
+	return fmt.Sprintf("device %d (%s, %d workers)", d.id, kind, d.workers)
+}
+
+// Spreads the reading jobs of the scanner over the devices the files are stored on. Every device gets
+// its own workers, so several disks are read in parallel without too many jobs on a single one.
+type deviceScheduler struct {
+	config   *Config
+	deviceID func(path string) (uint64, error) // Looks up the device of a directory
+	mu       sync.Mutex
+	devices  map[uint64]*ioDevice
+}
+
+func newDeviceScheduler(config *Config) *deviceScheduler {
+	return &deviceScheduler{config: config, deviceID: deviceID, devices: make(map[uint64]*ioDevice)}
+}
+
+// Returns the device with the id, its rotational flag is read once
+func (d *deviceScheduler) device(id uint64) *ioDevice {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if device, ok := d.devices[id]; ok {
+		return device
+	}
+	device := &ioDevice{id: id, workers: max(1, d.config.SSDWorkers)}
+	if rotational, found := isRotational(id); found && rotational {
+		device.rotational = true
+		device.workers = max(1, d.config.HDDWorkers)
+	}
+	device.slots = make(chan struct{}, device.workers)
+	d.devices[id] = device
+	if d.config.Debug {
+		fmt.Printf("  Reading from %s\n", device)
+	}
+	return device
+}
+
+// Calls fn for the jobs 0 to n-1, paths returns the files a job reads. A job runs while it holds a slot of every
+// device it reads from, so no device is read by more jobs than it has workers, not even by several runs at the
+// same time. The jobs are queued on the device of their first file, all devices are read at the same time.
+// Returns when all jobs are done. fn must not call run itself, the slots it holds could be needed by the inner jobs.
+func (d *deviceScheduler) run(n int, paths func(int) []string, fn func(int)) {
+	// files of a directory are on the device of the directory, it is looked up once
+	dirDevices := make(map[string]*ioDevice)
+	lookup := func(path string) *ioDevice {
+		dir := filepath.Dir(path)
+		if device, ok := dirDevices[dir]; ok {
+			return device
+		}
+		id, err := d.deviceID(dir)
+		if err != nil {
+			id = 0 // unknown device, e.g. a vanished directory, the job fails on its own
+		}
+		device := d.device(id)
+		dirDevices[dir] = device
+		return device
+	}
+
+	jobDevices := make([][]*ioDevice, n)
+	queues := make(map[*ioDevice][]int)
+	for i := range n {
+		for _, path := range paths(i) {
+			device := lookup(path)
+			if !slices.Contains(jobDevices[i], device) {
+				jobDevices[i] = append(jobDevices[i], device)
+			}
+		}
+		if len(jobDevices[i]) == 0 {
+			jobDevices[i] = []*ioDevice{d.device(0)}
+		}
+		queues[jobDevices[i][0]] = append(queues[jobDevices[i][0]], i)
+		// slots are taken in the order of the device ids, so two jobs never wait for each other
+		slices.SortFunc(jobDevices[i], func(a, b *ioDevice) int { return cmp.Compare(a.id, b.id) })
+	}
+
+	var wg sync.WaitGroup
+	for device, queue := range queues {
+		jobsChan := make(chan int, len(queue))
+		for _, i := range queue {
+			jobsChan <- i
+		}
+		close(jobsChan)
+
+		for range min(device.workers, len(queue)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobsChan {
+					for _, jobDevice := range jobDevices[i] {
+						jobDevice.slots <- struct{}{}
+					}
+					fn(i)
+					for _, jobDevice := range jobDevices[i] {
+						<-jobDevice.slots
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reads the rotational flag of the block device from /sys/dev/block. Partitions have no queue directory
+// of their own, their disk is the parent directory. Returns false for devices without the flag, e.g. network
+// filesystems, and whether the flag was found.
+func isRotational(dev uint64) (bool, bool) {
+	// the entry is a link to the device directory, resolved before going to the parent
+	dir, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(dev), unix.Minor(dev)))
+	if err != nil {
+		return false, false
+	}
+	for _, dir := range []string{dir, filepath.Dir(dir)} {
+		flag, err := os.ReadFile(filepath.Join(dir, "queue", "rotational"))
+		if err == nil {
+			return strings.TrimSpace(string(flag)) == "1", true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package core
+
+// Returns whether the block device is a spinning disk. Not available on this platform, every device counts as SSD.
+func isRotational(dev uint64) (bool, bool) {
+	return false, false
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeviceSchedulerLimitsJobsPerDevice(t *testing.T) {
+	const workers = 2
+	d := newDeviceScheduler(&Config{HDDWorkers: workers, SSDWorkers: workers})
+	// the files of the directories dev1 and dev2 are on the devices 1 and 2
+	d.deviceID = func(dir string) (uint64, error) {
+		var id uint64
+		_, err := fmt.Sscanf(filepath.Base(dir), "dev%d", &id)
+		return id, err
+	}
+
+	// jobs read from one device or from both, like the comparison of two files
+	jobPaths := [][]string{
+		{"/dev1/a"},
+		{"/dev2/b"},
+		{"/dev1/c", "/dev2/d"},
+		{"/dev2/e", "/dev1/f"},
+		{"/dev1/g", "/dev1/h"},
+	}
+
+	var mu sync.Mutex
+	active := make(map[uint64]int)
+	maxActive := make(map[uint64]int)
+	job := func(paths []string) {
+		ids := make(map[uint64]bool)
+		for _, path := range paths {
+			id, _ := d.deviceID(filepath.Dir(path))
+			ids[id] = true
+		}
+		mu.Lock()
+		for id := range ids {
+			active[id]++
+			maxActive[id] = max(maxActive[id], active[id])
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		for id := range ids {
+			active[id]--
+		}
+		mu.Unlock()
+	}
+
+	// several runs at the same time share the workers of the devices
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := 10 * len(jobPaths)
+			paths := func(i int) []string { return jobPaths[i%len(jobPaths)] }
+			d.run(n, paths, func(i int) { job(paths(i)) })
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range []uint64{1, 2} {
+		if maxActive[id] == 0 {
+			t.Errorf("no job read from device %d", id)
+		}
+		if maxActive[id] > workers {
+			t.Errorf("%d jobs read from device %d at the same time, it has %d workers", maxActive[id], id, workers)
+		}
+	}
+}
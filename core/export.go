@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bufio"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
@@ -11,94 +12,132 @@ import (
 
 // Export the duplicates in a report
 func (a *App) Export() {
-	files := a.index.GetAllDupes()
+	// the groups are written while they are read, only their number is needed up front
+	count, err := a.index.CountFileGroups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	// No files in FileIndex skip
-	if len(files) == 0 {
+	if count == 0 {
 		fmt.Fprintf(os.Stderr, "No duplicate files in database\n")
 		os.Exit(1)
 	}
 
-	fmt.Printf("# DupeFiles Export - Found %d groups of possible duplicate files\n", len(files))
-	fmt.Printf("# Format: [Group Number] [Hash] [File Count] [Total Size]\n")
+	fmt.Printf("# DupeFiles Export - Found %d groups of duplicate files\n", count)
+	fmt.Printf("# Format: [Group Number] [Hash] [File Count] [Total Size] [Verification]\n")
 	fmt.Println("#")
 
 	totalDuplicateSize := int64(0)
 	totalFiles := 0
+	groups := 0
 
-	for i, file := range files {
-		totalFiles++
-		groupSize := file.Size // Größe des duplizierten Files
+	err = a.index.ForEachFileGroup(func(group *FileGroup) error {
+		groups++
+		totalFiles += len(group.Files)
+		groupSize := group.Size * int64(len(group.Files)) // Größe aller Dateien der Gruppe
 		totalDuplicateSize += groupSize
 
-		// Todo: Check printf parameters here. Why "1"?
-		fmt.Printf("[Group %d] %v %d %s\n", i+1, file.Hash, 1, HumanizeBytes(groupSize))
-		fmt.Printf("- %s (%s)\n", file.Path, file.HumanizedSize)
+		fmt.Printf("[Group %d] %s %d %s %s\n", groups, group.Hash, len(group.Files), HumanizeBytes(groupSize), group.Method)
+		for _, file := range group.Files {
+			fmt.Printf("- %s (%s)\n", file.Path, file.HumanizedSize)
+		}
 		fmt.Println() // Empty line between groups
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("# Summary: %d possible duplicate files in %d groups, %s total used space\n",
-		totalFiles, len(files), HumanizeBytes(totalDuplicateSize))
+	fmt.Printf("# Summary: %d duplicate files in %d groups, %s total used space\n",
+		totalFiles, groups, HumanizeBytes(totalDuplicateSize))
 }
 
-func (a *App) ExportToJsonFile(filename string) error {
-	files := a.index.GetAllDupes()
-
-	// No files in FileIndex skip
-	if len(files) == 0 {
-		return fmt.Errorf("no duplicate files in database")
-	}
+// Calls fn with every verified duplicate group for exporting, one group at a time.
+// Returns the number of groups.
+func (a *App) forEachExportGroup(fn func(*DuplicateGroup) error) (int, error) {
+	count := 0
+	err := a.index.ForEachFileGroup(func(group *FileGroup) error {
+		count++
+		duplicateGroup := &DuplicateGroup{
+			GroupID:    count,
+			Hash:       group.Hash,
+			Size:       group.Size,
+			HumanSize:  HumanizeBytes(group.Size),
+			FileCount:  len(group.Files),
+			Method:     group.Method,
+			VerifiedAt: group.VerifiedAt,
+			Files:      []string{},
+		}
+		for _, file := range group.Files {
+			duplicateGroup.Files = append(duplicateGroup.Files, file.Path)
+		}
+		return fn(duplicateGroup)
+	})
+	return count, err
+}
 
+// Creates the export file, with a generated name if filename is empty
+func createExportFile(filename, extension string) (*os.File, error) {
 	// Create output filename if not provided
 	if filename == "" {
 		timestamp := time.Now().Format("20060102_150405")
-		filename = fmt.Sprintf("dupefiles_export_%s.json", timestamp)
+		filename = fmt.Sprintf("dupefiles_export_%s.%s", timestamp, extension)
 	}
 
 	// Ensure the directory exists
 	dir := filepath.Dir(filename)
 	if dir != "." {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory: %v", err)
+			return nil, fmt.Errorf("failed to create directory: %v", err)
 		}
 	}
 
-	// Group files by hash
-	groups := make(map[string]*DuplicateGroup)
-	for _, file := range files {
-		hash := file.Hash.String
-		if _, exists := groups[hash]; !exists {
-			groups[hash] = &DuplicateGroup{
-				GroupID:   len(groups) + 1,
-				Hash:      hash,
-				Size:      file.Size,
-				HumanSize: HumanizeBytes(file.Size),
-				FileCount: 0,
-				Files:     []string{},
-			}
-		}
-		groups[hash].FileCount++
-		groups[hash].Files = append(groups[hash].Files, file.Path)
+	return os.Create(filename)
+}
+
+func (a *App) ExportToJsonFile(filename string) error {
+	// No files in FileIndex skip
+	if count, err := a.index.CountFileGroups(); err != nil {
+		return err
+	} else if count == 0 {
+		return fmt.Errorf("no duplicate files in database")
 	}
 
-	// Convert map to slice for JSON output
-	var duplicateGroups []*DuplicateGroup
-	for _, group := range groups {
-		duplicateGroups = append(duplicateGroups, group)
+	file, err := createExportFile(filename, "json")
+	if err != nil {
+		return fmt.Errorf("failed to create JSON file: %v", err)
 	}
+	defer file.Close()
 
-	// Create JSON output
-	jsonData, err := json.MarshalIndent(duplicateGroups, "", "  ")
+	// the array is written one group at a time, with the same indentation as MarshalIndent
+	writer := bufio.NewWriter(file)
+	writer.WriteString("[")
+	count, err := a.forEachExportGroup(func(group *DuplicateGroup) error {
+		jsonData, err := json.MarshalIndent(group, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %v", err)
+		}
+		if group.GroupID > 1 {
+			writer.WriteString(",")
+		}
+		writer.WriteString("\n  ")
+		_, err = writer.Write(jsonData)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %v", err)
+		return err
 	}
+	writer.WriteString("\n]")
 
 	// Write to file
-	if err := os.WriteFile(filename, jsonData, 0644); err != nil {
+	if err := writer.Flush(); err != nil {
 		return fmt.Errorf("failed to write JSON file: %v", err)
 	}
 
-	fmt.Printf("Exported %d duplicate groups to %s\n", len(duplicateGroups), filename)
+	fmt.Printf("Exported %d duplicate groups to %s\n", count, file.Name())
 	return nil
 }
 
@@ -107,47 +146,15 @@ func (a *App) ExportToCSVFile(filename string) error {
 }
 
 func (a *App) ExportToCSVFileWithSeparator(filename string, separator rune) error {
-	files := a.index.GetAllDupes()
-
 	// No files in FileIndex skip
-	if len(files) == 0 {
+	if count, err := a.index.CountFileGroups(); err != nil {
+		return err
+	} else if count == 0 {
 		return fmt.Errorf("no duplicate files in database")
 	}
 
-	// Create output filename if not provided
-	if filename == "" {
-		timestamp := time.Now().Format("20060102_150405")
-		filename = fmt.Sprintf("dupefiles_export_%s.csv", timestamp)
-	}
-
-	// Ensure the directory exists
-	dir := filepath.Dir(filename)
-	if dir != "." {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory: %v", err)
-		}
-	}
-
-	// Group files by hash
-	groups := make(map[string]*DuplicateGroup)
-	for _, file := range files {
-		hash := file.Hash.String
-		if _, exists := groups[hash]; !exists {
-			groups[hash] = &DuplicateGroup{
-				GroupID:   len(groups) + 1,
-				Hash:      hash,
-				Size:      file.Size,
-				HumanSize: HumanizeBytes(file.Size),
-				FileCount: 0,
-				Files:     []string{},
-			}
-		}
-		groups[hash].FileCount++
-		groups[hash].Files = append(groups[hash].Files, file.Path)
-	}
-
 	// Create CSV file
-	file, err := os.Create(filename)
+	file, err := createExportFile(filename, "csv")
 	if err != nil {
 		return fmt.Errorf("failed to create CSV file: %v", err)
 	}
@@ -159,13 +166,13 @@ func (a *App) ExportToCSVFileWithSeparator(filename string, separator rune) erro
 	defer writer.Flush()
 
 	// Write header
-	header := []string{"Group ID", "Hash", "Size (bytes)", "Human Size", "File Count", "File Path"}
+	header := []string{"Group ID", "Hash", "Size (bytes)", "Human Size", "File Count", "Verification", "File Path"}
 	if err := writer.Write(header); err != nil {
 		return fmt.Errorf("failed to write CSV header: %v", err)
 	}
 
 	// Write data
-	for _, group := range groups {
+	count, err := a.forEachExportGroup(func(group *DuplicateGroup) error {
 		for _, filePath := range group.Files {
 			record := []string{
 				fmt.Sprintf("%d", group.GroupID),
@@ -173,14 +180,19 @@ func (a *App) ExportToCSVFileWithSeparator(filename string, separator rune) erro
 				fmt.Sprintf("%d", group.Size),
 				group.HumanSize,
 				fmt.Sprintf("%d", group.FileCount),
+				group.Method,
 				filePath,
 			}
 			if err := writer.Write(record); err != nil {
 				return fmt.Errorf("failed to write CSV record: %v", err)
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Exported %d duplicate groups to %s\n", len(groups), filename)
+	fmt.Printf("Exported %d duplicate groups to %s\n", count, file.Name())
 	return nil
 }
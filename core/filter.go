@@ -0,0 +1,362 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Layout of the dates of --newer and --older
+const filterDateLayout = "2006-01-02"
+
+// Filter decides which files of a directory walk are indexed.
+// Patterns are globs or, with the prefix "re:", regular expressions. A glob without a slash is matched against
+// the file or directory name, a glob with a slash against the path relative to the walked directory
+// (like in .gitignore), where ** matches any number of directories, e.g. **/thumbs/*.jpg. Regular expressions are matched against the relative path.
+// Exclude patterns win over include patterns, excluded directories are not walked at all.
+type Filter struct {
+	Include     []string // Files must match one of these patterns, all files if empty
+	Exclude     []string // Files matching one of these patterns are skipped
+	ExcludeDirs []string // Directories matching one of these patterns are not walked
+	MinSize     int64    // Minimum file size in bytes
+	MaxSize     int64    // Maximum file size in bytes, 0 for no limit
+	NewerThan   int64    // Files must be modified at or after this unix timestamp, 0 for no limit
+	OlderThan   int64    // Files must be modified before this unix timestamp, 0 for no limit
+
+	include     []*filterPattern
+	exclude     []*filterPattern
+	excludeDirs []*filterPattern
+}
+
+// Raw filter settings from the command line
+type FilterOptions struct {
+	Include     []string
+	Exclude     []string
+	ExcludeDirs []string
+	MinSize     string // Size like 10K or 1.5M, the configured minimum file size if empty
+	MaxSize     string
+	NewerThan   string // Date like 2024-01-31
+	OlderThan   string
+}
+
+type filterPattern struct {
+	text  string
+	regex *regexp.Regexp
+	glob  []string // Segments of a path glob, nil for a name glob
+}
+
+// Creates a filter from the command line settings
+func NewFilter(options FilterOptions, defaultMinSize int64) (*Filter, error) {
+	filter := &Filter{
+		Include:     options.Include,
+		Exclude:     options.Exclude,
+		ExcludeDirs: options.ExcludeDirs,
+		MinSize:     defaultMinSize,
+	}
+
+	var err error
+	if options.MinSize != "" {
+		if filter.MinSize, err = ParseBytes(options.MinSize); err != nil {
+			return nil, fmt.Errorf("invalid min size: %v", err)
+		}
+	}
+	if options.MaxSize != "" {
+		if filter.MaxSize, err = ParseBytes(options.MaxSize); err != nil {
+			return nil, fmt.Errorf("invalid max size: %v", err)
+		}
+	}
+	if options.NewerThan != "" {
+		if filter.NewerThan, err = parseFilterDate(options.NewerThan); err != nil {
+			return nil, err
+		}
+	}
+	if options.OlderThan != "" {
+		if filter.OlderThan, err = parseFilterDate(options.OlderThan); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := filter.compile(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// Creates the filter from the command line settings, the configured minimum file size is the default
+func (a *App) NewFilter(options FilterOptions) *Filter {
+	filter, err := NewFilter(options, a.config.MinFileSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return filter
+}
+
+// Parses a filter stored in the roots table. Roots added before filters existed store a single name glob.
+func parseStoredFilter(text string, minSize int64) (*Filter, error) {
+	filter := &Filter{}
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal([]byte(text), filter); err != nil {
+			return nil, fmt.Errorf("failed to parse filter %s: %v", text, err)
+		}
+	} else if text != "" {
+		filter.Include = []string{text}
+	}
+	filter.MinSize = minSize
+
+	if err := filter.compile(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// Returns the filter as stored in the roots table
+func (f *Filter) stored() (string, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode filter: %v", err)
+	}
+	return string(data), nil
+}
+
+func parseFilterDate(value string) (int64, error) {
+	date, err := time.ParseInLocation(filterDateLayout, value, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+	}
+	return date.Unix(), nil
+}
+
+func (f *Filter) compile() error {
+	var err error
+	if f.include, err = compilePatterns(f.Include); err != nil {
+		return err
+	}
+	if f.exclude, err = compilePatterns(f.Exclude); err != nil {
+		return err
+	}
+	f.excludeDirs, err = compilePatterns(f.ExcludeDirs)
+	return err
+}
+
+func compilePatterns(texts []string) ([]*filterPattern, error) {
+	var patterns []*filterPattern
+	for _, text := range texts {
+		pattern := &filterPattern{text: text}
+		if expr, ok := strings.CutPrefix(text, "re:"); ok {
+			regex, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %v", expr, err)
+			}
+			pattern.regex = regex
+		} else {
+			glob := filepath.ToSlash(text)
+			if _, err := path.Match(strings.ReplaceAll(glob, "**", "*"), ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", text, err)
+			}
+			if strings.Contains(glob, "/") {
+				pattern.glob = strings.Split(strings.Trim(glob, "/"), "/")
+			}
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// Checks the pattern against a slash separated path relative to the walked directory
+func (p *filterPattern) match(relPath string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(relPath)
+	}
+	if p.glob == nil {
+		matched, _ := path.Match(p.text, path.Base(relPath))
+		return matched
+	}
+
+	return matchGlobSegments(p.glob, strings.Split(relPath, "/"))
+}
+
+// Matches glob segments against path segments, a ** segment matches any number of path segments
+func matchGlobSegments(glob, segments []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			glob = glob[1:]
+			if len(glob) == 0 {
+				return true
+			}
+			for i := range len(segments) + 1 {
+				if matchGlobSegments(glob, segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(glob[0], segments[0]); !matched {
+			return false
+		}
+		glob, segments = glob[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+func firstMatch(patterns []*filterPattern, relPath string) *filterPattern {
+	for _, pattern := range patterns {
+		if pattern.match(relPath) {
+			return pattern
+		}
+	}
+	return nil
+}
+
+// Checks if the directory is walked. relPath is relative to the walked directory.
+// Returns the reason of the decision.
+func (f *Filter) MatchDir(relPath string) (bool, string) {
+	relPath = filepath.ToSlash(relPath)
+	if pattern := firstMatch(f.excludeDirs, relPath); pattern != nil {
+		return false, fmt.Sprintf("excluded by directory pattern %q", pattern.text)
+	}
+	return true, "walked"
+}
+
+// Checks if the file is indexed. relPath is relative to the walked directory.
+// Returns the reason of the decision.
+func (f *Filter) MatchFile(relPath string, size, modTime int64) (bool, string) {
+	relPath = filepath.ToSlash(relPath)
+	if pattern := firstMatch(f.exclude, relPath); pattern != nil {
+		return false, fmt.Sprintf("excluded by pattern %q", pattern.text)
+	}
+
+	reason := "included, no include patterns"
+	if len(f.include) > 0 {
+		pattern := firstMatch(f.include, relPath)
+		if pattern == nil {
+			return false, "excluded, matches no include pattern"
+		}
+		reason = fmt.Sprintf("included by pattern %q", pattern.text)
+	}
+
+	if f.MinSize > 0 && size < f.MinSize {
+		return false, fmt.Sprintf("excluded, smaller than min size %s", HumanizeBytes(f.MinSize))
+	}
+	if f.MaxSize > 0 && size > f.MaxSize {
+		return false, fmt.Sprintf("excluded, larger than max size %s", HumanizeBytes(f.MaxSize))
+	}
+	if f.NewerThan > 0 && modTime < f.NewerThan {
+		return false, fmt.Sprintf("excluded, modified before %s", time.Unix(f.NewerThan, 0).Format(filterDateLayout))
+	}
+	if f.OlderThan > 0 && modTime >= f.OlderThan {
+		return false, fmt.Sprintf("excluded, modified after %s", time.Unix(f.OlderThan, 0).Format(filterDateLayout))
+	}
+	return true, reason
+}
+
+// Returns a short description of the filter, e.g. for --roots
+func (f *Filter) String() string {
+	var parts []string
+	if len(f.Include) > 0 {
+		parts = append(parts, "include "+strings.Join(f.Include, ","))
+	}
+	if len(f.Exclude) > 0 {
+		parts = append(parts, "exclude "+strings.Join(f.Exclude, ","))
+	}
+	if len(f.ExcludeDirs) > 0 {
+		parts = append(parts, "exclude dirs "+strings.Join(f.ExcludeDirs, ","))
+	}
+	size := "min size " + HumanizeBytes(f.MinSize)
+	if f.MaxSize > 0 {
+		size += ", max size " + HumanizeBytes(f.MaxSize)
+	}
+	parts = append(parts, size)
+	if f.NewerThan > 0 {
+		parts = append(parts, "newer than "+time.Unix(f.NewerThan, 0).Format(filterDateLayout))
+	}
+	if f.OlderThan > 0 {
+		parts = append(parts, "older than "+time.Unix(f.OlderThan, 0).Format(filterDateLayout))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Shows why a file or directory is indexed or not: the root it belongs to, the directories
+// on the way to it and the filter rule or ignore file that decided. Paths in no root are checked against the given filter.
+func (a *App) Explain(target string, filter *Filter) {
+	absPath, err := filepath.Abs(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	base := filepath.Dir(absPath)
+	recursive := true
+	fmt.Printf("Path: %s\n", absPath)
+	if root := a.rootFor(absPath); root != nil {
+		fmt.Printf("Root: %s (%s)\n", root.Path, root.Name())
+		base, filter, recursive = root.Path, root.Filter, root.Recursive
+	} else {
+		fmt.Println("Root: none, using the filter of the command line")
+	}
+	fmt.Printf("Filter: %s\n", filter)
+
+	relPath, err := filepath.Rel(base, absPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ignore := newIgnoreTracker(base, a.config.IgnoreFilename)
+	ignore.ignored(base, true)
+
+	// every directory between the root and the path must be walked
+	var dirs []string
+	if relPath != "." {
+		dirs = strings.Split(filepath.ToSlash(relPath), "/")
+	}
+	if !info.IsDir() {
+		dirs = dirs[:len(dirs)-1]
+	}
+	for i := range dirs {
+		dir := strings.Join(dirs[:i+1], "/")
+		if !recursive {
+			fmt.Printf("Directory %s: not walked, the root is not recursive\n", dir)
+			fmt.Println("Result: excluded")
+			return
+		}
+		walked, reason := filter.MatchDir(dir)
+		if rule := ignore.ignored(filepath.Join(base, dir), true); walked && rule != nil {
+			walked, reason = false, fmt.Sprintf("ignored by %q in %s", rule.text, rule.source)
+		}
+		fmt.Printf("Directory %s: %s\n", dir, reason)
+		if !walked {
+			fmt.Println("Result: excluded")
+			return
+		}
+	}
+
+	if info.IsDir() {
+		fmt.Println("Result: walked")
+		return
+	}
+
+	included, reason := filter.MatchFile(relPath, info.Size(), info.ModTime().Unix())
+	if rule := ignore.ignored(absPath, false); rule != nil {
+		included, reason = false, fmt.Sprintf("ignored by %q in %s", rule.text, rule.source)
+	}
+	fmt.Printf("File %s: %s\n", filepath.ToSlash(relPath), reason)
+	if included {
+		fmt.Println("Result: included")
+	} else {
+		fmt.Println("Result: excluded")
+	}
+}
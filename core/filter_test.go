@@ -0,0 +1,410 @@
+package core
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchGlobSegments(t *testing.T) {
+	tests := []struct {
+		glob string
+		path string
+		want bool
+	}{
+		{glob: "a/b.jpg", path: "a/b.jpg", want: true},
+		{glob: "a/b.jpg", path: "x/a/b.jpg"},
+		{glob: "a/*.jpg", path: "a/b.jpg", want: true},
+		{glob: "a/*.jpg", path: "a/c/b.jpg"},
+		// ** matches no, one or several directories
+		{glob: "**/thumbs/*.jpg", path: "thumbs/a.jpg", want: true},
+		{glob: "**/thumbs/*.jpg", path: "x/thumbs/a.jpg", want: true},
+		{glob: "**/thumbs/*.jpg", path: "x/y/thumbs/a.jpg", want: true},
+		{glob: "**/thumbs/*.jpg", path: "x/thumbs/y/a.jpg"},
+		{glob: "a/**/b.jpg", path: "a/b.jpg", want: true},
+		{glob: "a/**/b.jpg", path: "a/x/y/b.jpg", want: true},
+		{glob: "a/**/b.jpg", path: "x/a/b.jpg"},
+		{glob: "a/**", path: "a/x/y/b.jpg", want: true},
+		{glob: "a/**", path: "b/x.jpg"},
+		{glob: "**/**/b.jpg", path: "x/b.jpg", want: true},
+		// ** only has a meaning as a whole segment
+		{glob: "a**/b.jpg", path: "abc/b.jpg", want: true},
+		{glob: "a**/b.jpg", path: "abc/x/b.jpg"},
+	}
+
+	for _, test := range tests {
+		got := matchGlobSegments(strings.Split(test.glob, "/"), strings.Split(test.path, "/"))
+		if got != test.want {
+			t.Errorf("%s matches %s: %v, want %v", test.glob, test.path, got, test.want)
+		}
+	}
+}
+
+func TestFilterMatchFile(t *testing.T) {
+	day := func(year int, month time.Month, day int) int64 {
+		return time.Date(year, month, day, 0, 0, 0, 0, time.Local).Unix()
+	}
+	modTime := day(2024, 3, 1)
+
+	tests := []struct {
+		name    string
+		options FilterOptions
+		relPath string
+		size    int64
+		modTime int64
+		want    bool
+		reason  string
+	}{
+		{
+			name:    "no patterns",
+			relPath: "sub/a.jpg",
+			want:    true,
+			reason:  "included, no include patterns",
+		},
+		{
+			name:    "name glob matches in subdirectories",
+			options: FilterOptions{Include: []string{"*.png", "*.jpg"}},
+			relPath: "sub/deep/a.jpg",
+			want:    true,
+			reason:  `included by pattern "*.jpg"`,
+		},
+		{
+			name:    "no include pattern matches",
+			options: FilterOptions{Include: []string{"*.png"}},
+			relPath: "a.jpg",
+			reason:  "excluded, matches no include pattern",
+		},
+		{
+			name:    "path glob is relative to the walked directory",
+			options: FilterOptions{Include: []string{"photos/*.jpg"}},
+			relPath: "other/photos/a.jpg",
+			reason:  "excluded, matches no include pattern",
+		},
+		{
+			name:    "exclude wins over include",
+			options: FilterOptions{Include: []string{"*.jpg"}, Exclude: []string{"**/thumbs/*.jpg"}},
+			relPath: "x/thumbs/a.jpg",
+			reason:  `excluded by pattern "**/thumbs/*.jpg"`,
+		},
+		{
+			name:    "exclude does not match",
+			options: FilterOptions{Include: []string{"*.jpg"}, Exclude: []string{"**/thumbs/*.jpg"}},
+			relPath: "x/pictures/a.jpg",
+			want:    true,
+			reason:  `included by pattern "*.jpg"`,
+		},
+		{
+			name:    "regular expression against the relative path",
+			options: FilterOptions{Exclude: []string{`re:^raw/.*\.cr2$`}},
+			relPath: "raw/2024/a.cr2",
+			reason:  `excluded by pattern "re:^raw/.*\\.cr2$"`,
+		},
+		{
+			name:    "regular expression does not match",
+			options: FilterOptions{Exclude: []string{`re:^raw/.*\.cr2$`}},
+			relPath: "other/raw/a.cr2",
+			want:    true,
+			reason:  "included, no include patterns",
+		},
+		{
+			name:    "patterns are checked before the size",
+			options: FilterOptions{Exclude: []string{"*.log"}, MinSize: "1K"},
+			relPath: "a.log",
+			size:    10,
+			reason:  `excluded by pattern "*.log"`,
+		},
+		{
+			name:    "smaller than min size",
+			options: FilterOptions{MinSize: "1K"},
+			relPath: "a.jpg",
+			size:    1023,
+			reason:  "excluded, smaller than min size 1.0 KB",
+		},
+		{
+			name:    "exactly min size",
+			options: FilterOptions{MinSize: "1K"},
+			relPath: "a.jpg",
+			size:    1024,
+			want:    true,
+			reason:  "included, no include patterns",
+		},
+		{
+			name:    "larger than max size",
+			options: FilterOptions{MaxSize: "1M"},
+			relPath: "a.jpg",
+			size:    1024*1024 + 1,
+			reason:  "excluded, larger than max size 1.0 MB",
+		},
+		{
+			name:    "exactly max size",
+			options: FilterOptions{MaxSize: "1M"},
+			relPath: "a.jpg",
+			size:    1024 * 1024,
+			want:    true,
+			reason:  "included, no include patterns",
+		},
+		{
+			name:    "modified before newer than",
+			options: FilterOptions{NewerThan: "2024-03-02"},
+			relPath: "a.jpg",
+			modTime: modTime,
+			reason:  "excluded, modified before 2024-03-02",
+		},
+		{
+			name:    "modified on the day of newer than",
+			options: FilterOptions{NewerThan: "2024-03-01"},
+			relPath: "a.jpg",
+			modTime: modTime,
+			want:    true,
+			reason:  "included, no include patterns",
+		},
+		{
+			name:    "modified on the day of older than",
+			options: FilterOptions{OlderThan: "2024-03-01"},
+			relPath: "a.jpg",
+			modTime: modTime,
+			reason:  "excluded, modified after 2024-03-01",
+		},
+		{
+			name:    "modified before older than",
+			options: FilterOptions{OlderThan: "2024-03-02"},
+			relPath: "a.jpg",
+			modTime: modTime,
+			want:    true,
+			reason:  "included, no include patterns",
+		},
+		{
+			name:    "between newer than and older than",
+			options: FilterOptions{Include: []string{"*.jpg"}, NewerThan: "2024-01-01", OlderThan: "2024-06-01"},
+			relPath: "a.jpg",
+			modTime: day(2024, 5, 31),
+			want:    true,
+			reason:  `included by pattern "*.jpg"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewFilter(test.options, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, reason := filter.MatchFile(filepath.FromSlash(test.relPath), test.size, test.modTime)
+			if got != test.want || reason != test.reason {
+				t.Errorf("got %v, %q, want %v, %q", got, reason, test.want, test.reason)
+			}
+		})
+	}
+}
+
+func TestFilterMatchDir(t *testing.T) {
+	filter, err := NewFilter(FilterOptions{
+		Exclude:     []string{"cache"},
+		ExcludeDirs: []string{"node_modules", "build/tmp", "re:^\\.git$"},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		relPath string
+		want    bool
+		reason  string
+	}{
+		{relPath: "node_modules", reason: `excluded by directory pattern "node_modules"`},
+		{relPath: "sub/node_modules", reason: `excluded by directory pattern "node_modules"`},
+		{relPath: "build/tmp", reason: `excluded by directory pattern "build/tmp"`},
+		{relPath: "sub/build/tmp", want: true, reason: "walked"},
+		{relPath: ".git", reason: `excluded by directory pattern "re:^\\.git$"`},
+		{relPath: "sub/.git", want: true, reason: "walked"},
+		// file patterns do not exclude directories
+		{relPath: "cache", want: true, reason: "walked"},
+	}
+
+	for _, test := range tests {
+		got, reason := filter.MatchDir(filepath.FromSlash(test.relPath))
+		if got != test.want || reason != test.reason {
+			t.Errorf("%s: got %v, %q, want %v, %q", test.relPath, got, reason, test.want, test.reason)
+		}
+	}
+}
+
+func TestNewFilterErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		options FilterOptions
+		want    string
+	}{
+		{name: "invalid glob", options: FilterOptions{Include: []string{"[a-"}}, want: `invalid pattern "[a-"`},
+		{name: "invalid regular expression", options: FilterOptions{Exclude: []string{"re:(a"}}, want: `invalid regular expression "(a"`},
+		{name: "invalid directory pattern", options: FilterOptions{ExcludeDirs: []string{"a/[b"}}, want: `invalid pattern "a/[b"`},
+		{name: "invalid size", options: FilterOptions{MinSize: "ten"}, want: "invalid min size"},
+		{name: "invalid date", options: FilterOptions{NewerThan: "01.02.2024"}, want: `invalid date "01.02.2024"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewFilter(test.options, 0)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+// Returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-output
+}
+
+func TestExplain(t *testing.T) {
+	content := strings.Repeat("x", 100)
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".dfignore":          "*.tmp\n",
+		"a.tmp":              content,
+		"small.jpg":          "tiny",
+		"node_modules/b.jpg": content,
+		"sub/.dfignore":      "private/\n",
+		"sub/private/c.jpg":  content,
+		"sub/thumbs/d.jpg":   content,
+		"sub/thumbs/d.png":   content,
+		"flat/f.jpg":         content,
+		"flat/sub/f.jpg":     content,
+	})
+	outside := t.TempDir()
+	writeTree(t, outside, map[string]string{
+		"e.jpg": content,
+		"e.log": content,
+	})
+
+	rootFilter, err := NewFilter(FilterOptions{Exclude: []string{"**/thumbs/*.jpg"}, ExcludeDirs: []string{"node_modules"}, MinSize: "50"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flatFilter, err := NewFilter(FilterOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// paths in no root are checked against the filter of the command line
+	cmdFilter, err := NewFilter(FilterOptions{Include: []string{"*.jpg"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flat is a root in the other root, the innermost root decides
+	a := &App{config: &Config{}, roots: []*Root{
+		{Path: root, Label: "main", Recursive: true, Filter: rootFilter},
+		{Path: filepath.Join(root, "flat"), Filter: flatFilter},
+	}}
+	rootLines := []string{"Root: " + root + " (main)", "Filter: " + rootFilter.String()}
+	flatLines := []string{"Root: " + filepath.Join(root, "flat") + " (flat)", "Filter: " + flatFilter.String()}
+	noRootLines := []string{"Root: none, using the filter of the command line", "Filter: " + cmdFilter.String()}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{
+			path: filepath.Join(root, "a.tmp"),
+			want: append(rootLines,
+				`File a.tmp: ignored by "*.tmp" in `+filepath.Join(root, IgnoreFilename)+":1",
+				"Result: excluded"),
+		},
+		{
+			path: filepath.Join(root, "small.jpg"),
+			want: append(rootLines,
+				"File small.jpg: excluded, smaller than min size 50 B",
+				"Result: excluded"),
+		},
+		{
+			path: filepath.Join(root, "node_modules", "b.jpg"),
+			want: append(rootLines,
+				`Directory node_modules: excluded by directory pattern "node_modules"`,
+				"Result: excluded"),
+		},
+		{
+			path: filepath.Join(root, "sub", "private", "c.jpg"),
+			want: append(rootLines,
+				"Directory sub: walked",
+				`Directory sub/private: ignored by "private/" in `+filepath.Join(root, "sub", IgnoreFilename)+":1",
+				"Result: excluded"),
+		},
+		{
+			path: filepath.Join(root, "sub", "thumbs", "d.jpg"),
+			want: append(rootLines,
+				"Directory sub: walked",
+				"Directory sub/thumbs: walked",
+				`File sub/thumbs/d.jpg: excluded by pattern "**/thumbs/*.jpg"`,
+				"Result: excluded"),
+		},
+		{
+			path: filepath.Join(root, "sub", "thumbs", "d.png"),
+			want: append(rootLines,
+				"Directory sub: walked",
+				"Directory sub/thumbs: walked",
+				"File sub/thumbs/d.png: included, no include patterns",
+				"Result: included"),
+		},
+		{
+			path: filepath.Join(root, "sub", "thumbs"),
+			want: append(rootLines,
+				"Directory sub: walked",
+				"Directory sub/thumbs: walked",
+				"Result: walked"),
+		},
+		{
+			path: filepath.Join(root, "flat", "f.jpg"),
+			want: append(flatLines,
+				"File f.jpg: included, no include patterns",
+				"Result: included"),
+		},
+		{
+			path: filepath.Join(root, "flat", "sub", "f.jpg"),
+			want: append(flatLines,
+				"Directory sub: not walked, the root is not recursive",
+				"Result: excluded"),
+		},
+		{
+			path: filepath.Join(outside, "e.jpg"),
+			want: append(noRootLines,
+				`File e.jpg: included by pattern "*.jpg"`,
+				"Result: included"),
+		},
+		{
+			path: filepath.Join(outside, "e.log"),
+			want: append(noRootLines,
+				"File e.log: excluded, matches no include pattern",
+				"Result: excluded"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(filepath.Base(test.path), func(t *testing.T) {
+			output := captureStdout(t, func() { a.Explain(test.path, cmdFilter) })
+			want := strings.Join(append([]string{"Path: " + test.path}, test.want...), "\n") + "\n"
+			if output != want {
+				t.Errorf("got\n%s\nwant\n%s", output, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+//go:build !windows
+
+package core
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+)
+
+// Returns the id of the device the file is stored on
+func deviceID(path string) (uint64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Dev), nil
+}
+
+// Checks if both paths are stored on the same filesystem
+func sameFilesystem(pathA, pathB string) (bool, error) {
+	devA, err := deviceID(pathA)
+	if err != nil {
+		return false, err
+	}
+	devB, err := deviceID(pathB)
+	if err != nil {
+		return false, err
+	}
+	return devA == devB, nil
+}
+
+// Returns the top directory of the volume the file is stored on, the mount point
+func volumeTopDir(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dev, err := deviceID(absPath)
+	if err != nil {
+		return "", err
+	}
+
+	dir := absPath
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir, nil
+		}
+		parentDev, err := deviceID(parent)
+		if err != nil || parentDev != dev {
+			return dir, nil
+		}
+		dir = parent
+	}
+}
+
+// Checks if a rename failed because source and destination are on different filesystems
+func isCrossDeviceError(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// Returns the number of hard links to the file
+func linkCount(path string) (uint64, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Nlink), nil
+}
+
+// Returns the device and inode of the file, the same for all hard links to it
+func fileID(path string) (fileKey, bool) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return fileKey{}, false
+	}
+	return fileKey{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
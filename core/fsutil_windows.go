@@ -0,0 +1,62 @@
+//go:build windows
+
+package core
+
+import (
+	"errors"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Returns an id of the drive the file is stored on, Windows has no device ids
+func deviceID(path string) (uint64, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToUpper(filepath.VolumeName(absPath))))
+	return h.Sum64(), nil
+}
+
+// Checks if both paths are stored on the same filesystem
+func sameFilesystem(pathA, pathB string) (bool, error) {
+	absA, err := filepath.Abs(pathA)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(pathB)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(absA), filepath.VolumeName(absB)), nil
+}
+
+// Returns the top directory of the volume the file is stored on, the root of its drive
+func volumeTopDir(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.VolumeName(absPath) + string(filepath.Separator), nil
+}
+
+// ERROR_NOT_SAME_DEVICE, returned when moving a file to another drive
+const errorNotSameDevice = syscall.Errno(17)
+
+// Checks if a rename failed because source and destination are on different drives
+func isCrossDeviceError(err error) bool {
+	return errors.Is(err, errorNotSameDevice)
+}
+
+// Returns the number of hard links to the file. Not available on Windows, every file counts as one link.
+func linkCount(path string) (uint64, error) {
+	return 1, nil
+}
+
+// Returns the id of the file shared by all hard links to it. Not available on Windows, every path counts as a file of its own.
+func fileID(path string) (fileKey, bool) {
+	return fileKey{}, false
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+const DefaultHashAlgorithm = "md5"
+
+// Hasher creates hash instances for one hash algorithm
+type Hasher interface {
+	Name() string
+	New() hash.Hash
+}
+
+type registeredHasher struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+func (h registeredHasher) Name() string   { return h.name }
+func (h registeredHasher) New() hash.Hash { return h.newHash() }
+
+// Registry of all known hash algorithms by name
+var hashers = make(map[string]Hasher)
+
+func init() {
+	RegisterHasher("md5", md5.New)
+	RegisterHasher("sha1", sha1.New)
+	RegisterHasher("sha256", sha256.New)
+	RegisterHasher("xxh3", func() hash.Hash { return xxh3.New() })
+	RegisterHasher("blake3", func() hash.Hash { return blake3.New() })
+}
+
+// Adds a hash algorithm to the registry. An existing algorithm with the same name gets replaced.
+func RegisterHasher(name string, newHash func() hash.Hash) {
+	hashers[strings.ToLower(name)] = registeredHasher{name: strings.ToLower(name), newHash: newHash}
+}
+
+// Returns the hasher registered for the given algorithm name
+func GetHasher(name string) (Hasher, error) {
+	hasher, ok := hashers[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q (available: %s)", name, strings.Join(HasherNames(), ", "))
+	}
+	return hasher, nil
+}
+
+// Returns the names of all registered hash algorithms
+func HasherNames() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
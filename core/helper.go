@@ -5,6 +5,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 )
 
 func HumanizeBytes(bytes int64) string {
@@ -20,6 +22,28 @@ func HumanizeBytes(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
+// Parses a size like 1024, 10K, 1.5MB or 2 GiB. Units are powers of 1024, like in HumanizeBytes.
+func ParseBytes(value string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(value))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "B"), "I")
+
+	multiplier := int64(1)
+	if text != "" {
+		if exp := strings.IndexByte("KMGTPE", text[len(text)-1]); exp >= 0 {
+			for range exp + 1 {
+				multiplier *= 1024
+			}
+			text = text[:len(text)-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
 func GetTrashPath() string {
 	var path string
 
@@ -30,14 +54,7 @@ func GetTrashPath() string {
 		path = os.Getenv("HOME") + "/.Trash"
 	case "linux":
 		// Linux (follows FreeDesktop.org trash specification)
-		// First try XDG_DATA_HOME
-		xdgDataHome := os.Getenv("XDG_DATA_HOME")
-		if xdgDataHome != "" {
-			path = filepath.Join(xdgDataHome, "Trash")
-		} else {
-			// Default to ~/.local/share/Trash
-			path = filepath.Join(os.Getenv("HOME"), ".local/share/Trash")
-		}
+		path = homeTrashDir()
 	case "windows":
 		// Windows
 		path = filepath.Join(os.Getenv("USERPROFILE"), "RecycleBin")
@@ -0,0 +1,194 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the ignore files read in every walked directory
+const IgnoreFilename = ".dfignore"
+
+// One line of an ignore file, with the syntax of .gitignore
+type ignoreRule struct {
+	text     string   // The line as written in the file
+	source   string   // File and line number, e.g. /data/.dfignore:3
+	glob     []string // Pattern split into path segments
+	negate   bool     // Pattern started with !, matching paths are not ignored
+	dirOnly  bool     // Pattern ended with /, it only matches directories
+	anchored bool     // Pattern contains a slash, it matches relative to the directory of the ignore file
+}
+
+// The rules of one ignore file. Paths are matched relative to dir.
+type ignoreFile struct {
+	dir   string
+	rules []*ignoreRule
+}
+
+// Reads an ignore file. A missing file returns nil and no error.
+func readIgnoreFile(filename, dir string) (*ignoreFile, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file := &ignoreFile{dir: dir}
+	scanner := bufio.NewScanner(f)
+	number := 0
+	for scanner.Scan() {
+		number++
+		rule := parseIgnoreRule(scanner.Text())
+		if rule == nil {
+			continue
+		}
+		rule.source = fmt.Sprintf("%s:%d", filename, number)
+		file.rules = append(file.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Parses one line of an ignore file. Returns nil for empty lines and comments.
+func parseIgnoreRule(line string) *ignoreRule {
+	text := strings.TrimRight(line, " \t\r")
+	if text == "" || strings.HasPrefix(text, "#") {
+		return nil
+	}
+
+	rule := &ignoreRule{text: text}
+	pattern := text
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return nil
+	}
+
+	// a slash at the start or in the middle anchors the pattern, like in .gitignore
+	rule.anchored = strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+		return nil
+	}
+	rule.glob = strings.Split(pattern, "/")
+	return rule
+}
+
+// Checks the rule against a slash separated path relative to the directory of the ignore file
+func (r *ignoreRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if !r.anchored {
+		matched, _ := path.Match(r.glob[0], path.Base(relPath))
+		return matched
+	}
+	return matchGlobSegments(r.glob, strings.Split(relPath, "/"))
+}
+
+// The ignore files that apply to a directory, from the outermost to the innermost
+type ignoreList struct {
+	parent *ignoreList
+	file   *ignoreFile
+}
+
+// Returns the rule deciding about the path, nil if no rule matches. The last matching rule of the
+// innermost ignore file wins, a matching negated rule means the path is not ignored.
+func (l *ignoreList) match(absPath string, isDir bool) *ignoreRule {
+	for list := l; list != nil; list = list.parent {
+		if list.file == nil {
+			continue
+		}
+		relPath, err := filepath.Rel(list.file.dir, absPath)
+		if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+			continue
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		rules := list.file.rules
+		for i := len(rules) - 1; i >= 0; i-- {
+			if rules[i].match(relPath, isDir) {
+				return rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the ignore list with the global ignore file, its rules are relative to root
+func newIgnoreBase(root, globalFilename string) *ignoreList {
+	base := &ignoreList{}
+	if globalFilename != "" {
+		global, err := readIgnoreFile(globalFilename, root)
+		if err != nil {
+			fmt.Printf("Warning: Failed to read ignore file %s: %v\n", globalFilename, err)
+		}
+		base.file = global
+	}
+	return base
+}
+
+// Returns the ignore list for the content of the directory: this list and the .dfignore file of the directory, if it has one
+func (l *ignoreList) enter(dir string) *ignoreList {
+	file, err := readIgnoreFile(filepath.Join(dir, IgnoreFilename), dir)
+	if err != nil {
+		fmt.Printf("Warning: Failed to read ignore file in %s: %v\n", dir, err)
+	}
+	if file == nil {
+		return l
+	}
+	return &ignoreList{parent: l, file: file}
+}
+
+// Returns the rule ignoring the path, or nil if the path is not ignored
+func (l *ignoreList) ignores(absPath string, isDir bool) *ignoreRule {
+	if rule := l.match(absPath, isDir); rule != nil && !rule.negate {
+		return rule
+	}
+	return nil
+}
+
+// Applies the global ignore file and the .dfignore files of the walked directories during a sequential walk.
+// Directories have to be passed to ignored before their content.
+type ignoreTracker struct {
+	lists map[string]*ignoreList // Ignore files that apply to the content of a directory
+	base  *ignoreList            // Global ignore file, for the walked directory
+}
+
+// Creates a tracker for a walk of root. The rules of the global ignore file are relative to root.
+func newIgnoreTracker(root, globalFilename string) *ignoreTracker {
+	return &ignoreTracker{lists: make(map[string]*ignoreList), base: newIgnoreBase(root, globalFilename)}
+}
+
+// Returns the rule ignoring the path, or nil if the path is not ignored. Directories that are not ignored
+// get their .dfignore file read, its rules apply to everything below the directory.
+func (t *ignoreTracker) ignored(absPath string, isDir bool) *ignoreRule {
+	parent, ok := t.lists[filepath.Dir(absPath)]
+	if !ok {
+		parent = t.base
+	}
+
+	if rule := parent.ignores(absPath, isDir); rule != nil {
+		return rule
+	}
+	if isDir {
+		t.lists[absPath] = parent.enter(absPath)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		relPath string
+		isDir   bool
+		match   bool
+		negate  bool
+	}{
+		// a pattern without a slash matches the name at any depth
+		{line: "*.tmp", relPath: "a.tmp", match: true},
+		{line: "*.tmp", relPath: "sub/deep/a.tmp", match: true},
+		{line: "*.tmp", relPath: "a.tmp.jpg"},
+		{line: "*.tmp  ", relPath: "a.tmp", match: true},
+		// a slash at the start or in the middle anchors the pattern
+		{line: "/c.jpg", relPath: "c.jpg", match: true},
+		{line: "/c.jpg", relPath: "sub/c.jpg"},
+		{line: "sub/c.jpg", relPath: "sub/c.jpg", match: true},
+		{line: "sub/c.jpg", relPath: "other/sub/c.jpg"},
+		{line: "sub/*.jpg", relPath: "sub/deep/c.jpg"},
+		// ** matches any number of directories
+		{line: "**/thumbs", relPath: "thumbs", isDir: true, match: true},
+		{line: "**/thumbs", relPath: "a/b/thumbs", isDir: true, match: true},
+		{line: "sub/**/c.jpg", relPath: "sub/c.jpg", match: true},
+		{line: "sub/**/c.jpg", relPath: "sub/a/b/c.jpg", match: true},
+		{line: "sub/**", relPath: "sub/a/b/c.jpg", match: true},
+		{line: "sub/**", relPath: "other/c.jpg"},
+		// a pattern ending with a slash only matches directories
+		{line: "build/", relPath: "build", isDir: true, match: true},
+		{line: "build/", relPath: "sub/build", isDir: true, match: true},
+		{line: "build/", relPath: "build"},
+		// negation and escapes
+		{line: "!keep.tmp", relPath: "keep.tmp", match: true, negate: true},
+		{line: `\!keep.tmp`, relPath: "!keep.tmp", match: true},
+		{line: `\#notes`, relPath: "#notes", match: true},
+	}
+
+	for _, test := range tests {
+		rule := parseIgnoreRule(test.line)
+		if rule == nil {
+			t.Errorf("%q: no rule", test.line)
+			continue
+		}
+		if got := rule.match(test.relPath, test.isDir); got != test.match {
+			t.Errorf("%q matches %s (dir: %v): %v, want %v", test.line, test.relPath, test.isDir, got, test.match)
+		}
+		if rule.negate != test.negate {
+			t.Errorf("%q: negate is %v, want %v", test.line, rule.negate, test.negate)
+		}
+	}
+
+	// empty lines, comments and invalid patterns are no rules
+	for _, line := range []string{"", "   ", "# comment", "!", "/", "[a-"} {
+		if rule := parseIgnoreRule(line); rule != nil {
+			t.Errorf("%q: got rule %+v, want none", line, rule)
+		}
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, IgnoreFilename)
+	if err := os.WriteFile(filename, []byte("# temporary files\n*.tmp\n\n!keep.tmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := readIgnoreFile(filename, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filename + ":2", filename + ":4"}
+	if len(file.rules) != len(want) {
+		t.Fatalf("got %d rules, want %d", len(file.rules), len(want))
+	}
+	for i, rule := range file.rules {
+		if rule.source != want[i] {
+			t.Errorf("rule %q: got source %s, want %s", rule.text, rule.source, want[i])
+		}
+	}
+
+	// a missing ignore file is no error
+	file, err = readIgnoreFile(filepath.Join(dir, "missing"), dir)
+	if file != nil || err != nil {
+		t.Errorf("got %v, %v for a missing file, want nil, nil", file, err)
+	}
+}
+
+// The .dfignore files apply to their directory and everything below it, the last matching rule of the
+// innermost file wins. The global ignore file applies to the whole walk and is overridden by every .dfignore.
+func TestIgnoreHierarchy(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".dfignore":          "*.tmp\n!keep.tmp\n!important.bak\n",
+		"sub/.dfignore":      "!*.tmp\n/local.jpg\n",
+		"sub/deep/.dfignore": "keep.tmp\n",
+	})
+	globalIgnore := filepath.Join(t.TempDir(), "ignore")
+	if err := os.WriteFile(globalIgnore, []byte("*.bak\nlogs/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// in walk order, directories before their content; want is the text of the ignoring rule
+	tests := []struct {
+		path  string
+		isDir bool
+		want  string
+	}{
+		{path: "a.tmp", want: "*.tmp"},
+		{path: "keep.tmp"},
+		{path: "x.bak", want: "*.bak"},
+		{path: "important.bak"},
+		{path: "logs", isDir: true, want: "logs/"},
+		{path: "local.jpg"},
+		{path: "sub", isDir: true},
+		{path: "sub/a.tmp"},
+		{path: "sub/local.jpg", want: "/local.jpg"},
+		{path: "sub/logs", isDir: true, want: "logs/"},
+		{path: "sub/deep", isDir: true},
+		{path: "sub/deep/local.jpg"},
+		{path: "sub/deep/b.tmp"},
+		{path: "sub/deep/keep.tmp", want: "keep.tmp"},
+		{path: "sub/deep/x.bak", want: "*.bak"},
+	}
+
+	tracker := newIgnoreTracker(root, globalIgnore)
+	tracker.ignored(root, true)
+	for _, test := range tests {
+		got := ""
+		if rule := tracker.ignored(filepath.Join(root, filepath.FromSlash(test.path)), test.isDir); rule != nil {
+			got = rule.text
+		}
+		if got != test.want {
+			t.Errorf("%s: ignored by %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	// the ignore lists of the walker give the same result
+	list := newIgnoreBase(root, globalIgnore).enter(root).enter(filepath.Join(root, "sub")).enter(filepath.Join(root, "sub", "deep"))
+	for _, test := range tests[11:] {
+		got := ""
+		if rule := list.ignores(filepath.Join(root, filepath.FromSlash(test.path)), test.isDir); rule != nil {
+			got = rule.text
+		}
+		if got != test.want {
+			t.Errorf("%s: ignored by %q in the ignore list, want %q", test.path, got, test.want)
+		}
+	}
+}
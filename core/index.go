@@ -6,89 +6,74 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Index of the files and duplicate groups. Files are read from the database when they are needed,
+// large indexes never have to fit into memory.
 type Index struct {
 	db     *sql.DB
-	files  map[string]*FileItem // Map of Guid to FileItem
 	config *Config
+	hasher Hasher // Configured hash algorithm
 }
 
 func NewIndex(config *Config) (*Index, error) {
 	dbFileName := config.DBFilename
 
-	_, err := os.Stat(dbFileName)
-	dbExists := !os.IsNotExist(err)
-
-	db, err := sql.Open("sqlite3", dbFileName+"?_journal_mode=WAL&_busy_timeout=5000") // Added WAL and busy_timeout
+	hasher, err := GetHasher(config.HashAlgorithm)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return nil, err
 	}
 
-	if !dbExists {
-
-		// create files table
-		_, err = db.Exec(`
-			CREATE TABLE files (
-				guid TEXT PRIMARY KEY,
-				path TEXT NOT NULL,
-				extension TEXT NOT NULL,
-				size INTEGER NOT NULL,
-				mod_time INTEGER NOT NULL, -- Added
-				hash TEXT,
-				humanized_size TEXT
-			)
-		`)
-		if err != nil {
-			db.Close()
-			return nil, fmt.Errorf("failed to create tables: %v", err)
-		}
-
-		// Create duplicates table
-		_, err = db.Exec(`
-			CREATE TABLE duplicates (
-				guid TEXT PRIMARY KEY,
-				scanned INTEGER NOT NULL,
-				FOREIGN KEY (guid) REFERENCES files(guid)
-			)
-		`)
-		if err != nil {
-			db.Close()
-			return nil, fmt.Errorf("failed to create duplicates table: %v", err)
-		}
+	db, err := openDatabase(dbFileName)
+	if err != nil {
+		return nil, err
+	}
 
-		_, err = db.Exec(`CREATE INDEX idx_files_path ON files (path)`) // Index path for faster lookups if needed
-		if err != nil {
-			// Log error but don't fail creation
-			fmt.Fprintf(os.Stderr, "Warning: failed to create path index: %v\n", err)
-		}
-		_, err = db.Exec(`CREATE INDEX idx_files_size ON files (size)`) // Index size for faster grouping
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: failed to create size index: %v\n", err)
-		}
-		_, err = db.Exec(`CREATE INDEX idx_files_hash ON files (hash)`) // Index hash for faster grouping
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: failed to create hash index: %v\n", err)
-		}
+	// bring the schema up to date, old databases keep their data
+	if _, err := applyMigrations(db, dbFileName, config.Debug); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %v", err)
 	}
 
 	index := &Index{
 		db:     db,
-		files:  make(map[string]*FileItem),
 		config: config,
+		hasher: hasher,
 	}
 
-	if dbExists {
-		err = index.loadFilesFromDB()
-		if err != nil {
-			db.Close()
-			return nil, fmt.Errorf("failed to load database: %v", err)
-		}
+	return index, nil
+}
+
+func openDatabase(dbFileName string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dbFileName+"?_journal_mode=WAL&_busy_timeout=5000") // Added WAL and busy_timeout
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
+	return db, nil
+}
 
-	return index, nil
+// Columns of the files table (aliased as f) in the order scanFileItem expects them
+const fileColumns = "f.guid, f.path, f.extension, f.size, f.mod_time, f.hash, f.humanized_size, f.partial_hash, f.hash_algorithm, f.link_target"
+
+// Adds a file or resets the row of a file that changed, the hashes get calculated again. A link target stays,
+// the path was replaced by a link to a kept file and is no duplicate of it.
+const upsertFileQuery = `
+	INSERT INTO files (guid, path, extension, size, mod_time, hash, humanized_size) VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (guid) DO UPDATE SET path = excluded.path, extension = excluded.extension, size = excluded.size,
+		mod_time = excluded.mod_time, hash = excluded.hash, humanized_size = excluded.humanized_size,
+		partial_hash = NULL, hash_algorithm = NULL`
+
+// Reads a row selected with fileColumns. Columns selected before fileColumns are read into leading.
+func scanFileItem(rows *sql.Rows, leading ...any) (*FileItem, error) {
+	var file FileItem
+	err := rows.Scan(append(leading, &file.Guid, &file.Path, &file.Extension, &file.Size, &file.ModTime, &file.Hash, &file.HumanizedSize, &file.PartialHash, &file.HashAlgorithm, &file.LinkTarget)...)
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
 }
 
 func (idx *Index) GetIndexPath() string {
@@ -96,150 +81,382 @@ func (idx *Index) GetIndexPath() string {
 	return absPath
 }
 
-func (idx *Index) GetAllFiles() []*FileItem {
-	files := make([]*FileItem, 0, len(idx.files))
-	for _, file := range idx.files {
-		files = append(files, file)
+// Returns the number of files in the index
+func (idx *Index) CountFiles() (int, error) {
+	var count int
+	if err := idx.db.QueryRow("SELECT COUNT(*) FROM files").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count files: %v", err)
 	}
-	return files
+	return count, nil
 }
 
-func (idx *Index) GetAllDupes() []*FileItem {
-	query := `
-		SELECT f.guid, f.path, f.extension, f.size, f.mod_time, f.hash, f.humanized_size 
+// Calls fn for every file the query selects, one row at a time. The query must select fileColumns.
+// An error returned by fn stops the iteration and is returned.
+func (idx *Index) forEachFile(fn func(*FileItem) error, query string, args ...any) error {
+	rows, err := idx.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query files: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file, err := scanFileItem(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan file row: %v", err)
+		}
+		if err := fn(file); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Calls fn for every file in the index, ordered by path
+func (idx *Index) ForEachFile(fn func(*FileItem) error) error {
+	return idx.forEachFile(fn, "SELECT "+fileColumns+" FROM files f ORDER BY f.path")
+}
+
+// Calls fn for every file in the directory or below it, dir must be absolute
+func (idx *Index) ForEachFileUnder(dir string, fn func(*FileItem) error) error {
+	// the range covers all paths starting with dir and a separator, the path index is used for it
+	prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+	upper := prefix[:len(prefix)-1] + string(rune(filepath.Separator+1))
+	return idx.forEachFile(fn, "SELECT "+fileColumns+" FROM files f WHERE f.path = ? OR (f.path >= ? AND f.path < ?)", dir, prefix, upper)
+}
+
+// Calls fn for every file of the current duplicate groups, largest files first
+func (idx *Index) ForEachDupe(fn func(*FileItem) error) error {
+	return idx.forEachFile(fn, `
+		SELECT `+fileColumns+`
 		FROM files f
-		INNER JOIN duplicates d ON f.guid = d.guid
-		ORDER BY f.size DESC, f.hash
-	`
+		INNER JOIN group_members m ON f.guid = m.guid
+		INNER JOIN groups g ON g.group_id = m.group_id
+		WHERE m.removed_at IS NULL AND `+currentGroupsCondition+`
+		ORDER BY g.size DESC, g.group_id, f.guid
+	`)
+}
 
-	rows, err := idx.db.Query(query)
+// Calls fn for every verified duplicate group of the latest scan, largest files first. Groups with less than two
+// files left are skipped. Only one group is in memory at a time.
+func (idx *Index) ForEachFileGroup(fn func(*FileGroup) error) error {
+	rows, err := idx.db.Query(`
+		SELECT g.group_id, g.hash, g.hash_algorithm, g.size, g.verified_at, g.method, ` + fileColumns + `
+		FROM groups g
+		INNER JOIN group_members m ON g.group_id = m.group_id
+		INNER JOIN files f ON f.guid = m.guid
+		WHERE m.removed_at IS NULL AND ` + currentGroupsCondition + `
+		ORDER BY g.size DESC, g.group_id, f.guid
+	`)
 	if err != nil {
-		fmt.Printf("Warning: Failed to query duplicate files: %v\n", err)
-		return []*FileItem{}
+		return fmt.Errorf("failed to query duplicate groups: %v", err)
 	}
 	defer rows.Close()
 
-	var duplicateFiles []*FileItem
+	var group *FileGroup
 	for rows.Next() {
-		var file FileItem
-		var hash sql.NullString
-		err := rows.Scan(&file.Guid, &file.Path, &file.Extension, &file.Size, &file.ModTime, &hash, &file.HumanizedSize)
+		var g FileGroup
+		file, err := scanFileItem(rows, &g.GroupID, &g.Hash, &g.HashAlgorithm, &g.Size, &g.VerifiedAt, &g.Method)
 		if err != nil {
-			fmt.Printf("Warning: Failed to scan duplicate file row: %v\n", err)
-			continue
+			return fmt.Errorf("failed to scan duplicate group row: %v", err)
+		}
+		if group == nil || group.GroupID != g.GroupID {
+			if group != nil && len(group.Files) > 1 {
+				if err := fn(group); err != nil {
+					return err
+				}
+			}
+			group = &g
 		}
-		file.Hash = hash
-		duplicateFiles = append(duplicateFiles, &file)
+		group.Files = append(group.Files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate duplicate groups: %v", err)
+	}
+	if group != nil && len(group.Files) > 1 {
+		return fn(group)
+	}
+	return nil
+}
+
+// Returns the number of groups ForEachFileGroup visits
+func (idx *Index) CountFileGroups() (int, error) {
+	var count int
+	err := idx.db.QueryRow(`
+		SELECT COUNT(*) FROM (
+			SELECT g.group_id
+			FROM groups g
+			INNER JOIN group_members m ON g.group_id = m.group_id
+			INNER JOIN files f ON f.guid = m.guid
+			WHERE m.removed_at IS NULL AND ` + currentGroupsCondition + `
+			GROUP BY g.group_id
+			HAVING COUNT(*) > 1
+		)
+	`).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count duplicate groups: %v", err)
 	}
+	return count, nil
+}
 
-	if err = rows.Err(); err != nil {
-		fmt.Printf("Warning: Error iterating duplicate files: %v\n", err)
+// Returns the verified duplicate groups of the latest scan, largest files first. Groups with less than two files left are skipped.
+func (idx *Index) GetFileGroups() []*FileGroup {
+	var groups []*FileGroup
+	err := idx.ForEachFileGroup(func(group *FileGroup) error {
+		groups = append(groups, group)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
 	}
+	return groups
+}
 
-	return duplicateFiles
+// Returns the files of all duplicate groups, each ordered by guid. Which file is kept decides the KeepPolicy.
+func (idx *Index) GetDuplicateFileGroups() [][]*FileItem {
+	var groups [][]*FileItem
+	for _, group := range idx.GetFileGroups() {
+		groups = append(groups, group.Files)
+	}
+	return groups
 }
 
-func (idx *Index) GetRestOfDuplicates() []*FileItem {
-	// get all duplicates except the first one of each size+hash group
-	query := `
-		SELECT f.guid, f.path, f.extension, f.size, f.mod_time, f.hash, f.humanized_size 
-		FROM files f
-		INNER JOIN duplicates d ON f.guid = d.guid
-		WHERE f.guid NOT IN (
-			SELECT MIN(f2.guid)
-			FROM files f2
-			INNER JOIN duplicates d2 ON f2.guid = d2.guid
-			GROUP BY f2.size, f2.hash
-		)
-		ORDER BY f.size DESC, f.hash
-	`
+// Removes a file from the current duplicate groups, e.g. after an action replaced or moved it
+func removeFromGroups(db dbExecutor, guid string) error {
+	_, err := db.Exec(`
+		UPDATE group_members SET removed_at = ?
+		WHERE guid = ? AND removed_at IS NULL
+			AND group_id IN (SELECT g.group_id FROM groups g WHERE `+currentGroupsCondition+`)
+	`, time.Now().Unix(), guid)
+	return err
+}
 
-	rows, err := idx.db.Query(query)
+// Changes the path (and guid) of a file that was moved
+func (idx *Index) UpdateFilePath(file *FileItem, newPath string) error {
+	oldGuid := file.Guid
+	newGuid := filepath.Clean(newPath)
+
+	_, err := idx.db.Exec(
+		"UPDATE files SET path = ?, guid = ? WHERE guid = ?",
+		newPath, newGuid, oldGuid,
+	)
 	if err != nil {
-		fmt.Printf("Warning: Failed to query duplicate files: %v\n", err)
-		return []*FileItem{}
+		return err
+	}
+
+	// the file left the place it was a duplicate at, a new scan decides about it
+	if err := removeFromGroups(idx.db, oldGuid); err != nil {
+		return err
+	}
+
+	file.Path = newPath
+	file.Guid = newGuid
+	return nil
+}
+
+// Updates a file that was replaced by a link to the kept file.
+// The file stays in the index, but is no longer a duplicate. For symbolic links
+// linkTarget is stored, so later scans skip the file.
+func (idx *Index) ReplacedByLink(file *FileItem, keep *FileItem, linkTarget string) error {
+	tx, err := idx.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	_, err = tx.Exec(
+		"UPDATE files SET size = ?, mod_time = ?, hash = ?, hash_algorithm = ?, partial_hash = ?, link_target = NULLIF(?, '') WHERE guid = ?",
+		keep.Size, keep.ModTime, keep.Hash, keep.HashAlgorithm, keep.PartialHash, linkTarget, file.Guid,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %v", file.Path, err)
+	}
+
+	err = removeFromGroups(tx, file.Guid)
+	if err != nil {
+		return fmt.Errorf("failed to remove %s from duplicate groups: %v", file.Path, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	file.Size = keep.Size
+	file.ModTime = keep.ModTime
+	file.Hash = keep.Hash
+	file.HashAlgorithm = keep.HashAlgorithm
+	file.PartialHash = keep.PartialHash
+	file.LinkTarget = sql.NullString{String: linkTarget, Valid: linkTarget != ""}
+	return nil
+}
+
+// Marks a file as a regular file again, after a link was replaced by a copy
+func (idx *Index) ClearLinkTarget(guid string) error {
+	_, err := idx.db.Exec("UPDATE files SET link_target = NULL WHERE guid = ?", guid)
+	return err
+}
+
+// Returns the protected roots stored in the index
+func (idx *Index) GetProtectedRoots() ([]string, error) {
+	rows, err := idx.db.Query("SELECT path FROM protected_roots ORDER BY path")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query protected roots: %v", err)
 	}
 	defer rows.Close()
 
-	var duplicateFiles []*FileItem
+	var roots []string
 	for rows.Next() {
-		var file FileItem
-		var hash sql.NullString
-		err := rows.Scan(&file.Guid, &file.Path, &file.Extension, &file.Size, &file.ModTime, &hash, &file.HumanizedSize)
-		if err != nil {
-			fmt.Printf("Warning: Failed to scan duplicate file row: %v\n", err)
-			continue
+		var root string
+		if err := rows.Scan(&root); err != nil {
+			return nil, fmt.Errorf("failed to scan protected root: %v", err)
 		}
-		file.Hash = hash
-		duplicateFiles = append(duplicateFiles, &file)
+		roots = append(roots, root)
 	}
+	return roots, rows.Err()
+}
 
-	if err = rows.Err(); err != nil {
-		fmt.Printf("Warning: Error iterating duplicate files: %v\n", err)
+func (idx *Index) AddProtectedRoot(root string) error {
+	_, err := idx.db.Exec("INSERT OR IGNORE INTO protected_roots (path, added) VALUES (?, ?)", root, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to add protected root: %v", err)
 	}
+	return nil
+}
 
-	return duplicateFiles
+// Removes a protected root, returns false if it was not protected
+func (idx *Index) RemoveProtectedRoot(root string) (bool, error) {
+	result, err := idx.db.Exec("DELETE FROM protected_roots WHERE path = ?", root)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove protected root: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	return rowsAffected > 0, nil
 }
 
-// Get all files that have hash values
-func (idx *Index) GetAllHashedFiles() []*FileItem {
-	query := `
-		SELECT f.guid, f.path, f.extension, f.size, f.mod_time, f.hash, f.humanized_size 
+// Calls fn for every file that has a hash value
+func (idx *Index) ForEachHashedFile(fn func(*FileItem) error) error {
+	return idx.forEachFile(fn, `
+		SELECT `+fileColumns+`
 		FROM files f
 		WHERE f.hash IS NOT NULL
 		ORDER BY f.size DESC, f.hash
-	`
+	`)
+}
+
+// Returns the file with the guid, nil if it is not in the index
+func (idx *Index) GetFileByGuid(guid string) *FileItem {
+	var found *FileItem
+	err := idx.forEachFile(func(file *FileItem) error {
+		found = file
+		return nil
+	}, "SELECT "+fileColumns+" FROM files f WHERE f.guid = ?", guid)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	return found
+}
 
-	rows, err := idx.db.Query(query)
+// Returns the sizes at least two files share, largest first. Files replaced by a symbolic link are no
+// duplicates of their target and are not counted.
+func (idx *Index) GetDuplicateSizes() ([]int64, error) {
+	rows, err := idx.db.Query(`
+		SELECT size FROM files
+		WHERE link_target IS NULL
+		GROUP BY size
+		HAVING COUNT(*) > 1
+		ORDER BY size DESC
+	`)
 	if err != nil {
-		fmt.Printf("Warning: Failed to query hashed files: %v\n", err)
-		return []*FileItem{}
+		return nil, fmt.Errorf("failed to query size groups: %v", err)
 	}
 	defer rows.Close()
 
-	var resultFiles []*FileItem
+	var sizes []int64
 	for rows.Next() {
-		var file FileItem
-		var hash sql.NullString
-		err := rows.Scan(&file.Guid, &file.Path, &file.Extension, &file.Size, &file.ModTime, &hash, &file.HumanizedSize)
-		if err != nil {
-			fmt.Printf("Warning: Failed to scan file row: %v\n", err)
-			continue
+		var size int64
+		if err := rows.Scan(&size); err != nil {
+			return nil, fmt.Errorf("failed to scan size group: %v", err)
 		}
-		file.Hash = hash
-		resultFiles = append(resultFiles, &file)
+		sizes = append(sizes, size)
 	}
+	return sizes, rows.Err()
+}
 
-	if err = rows.Err(); err != nil {
-		fmt.Printf("Warning: Error iterating files: %v\n", err)
+// Returns the files of the sizes that are not replaced by a symbolic link and in no group of the scan session,
+// grouped by size
+func (idx *Index) GetFilesBySizes(sizes []int64, sessionID int64) (map[int64][]*FileItem, error) {
+	sizeGroups := make(map[int64][]*FileItem)
+	for start := 0; start < len(sizes); start += maxQueryParams {
+		chunk := sizes[start:min(start+maxQueryParams, len(sizes))]
+		args := make([]any, len(chunk), len(chunk)+1)
+		for i, size := range chunk {
+			args[i] = size
+		}
+		args = append(args, sessionID)
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+
+		err := idx.forEachFile(func(file *FileItem) error {
+			sizeGroups[file.Size] = append(sizeGroups[file.Size], file)
+			return nil
+		}, "SELECT "+fileColumns+" FROM files f WHERE f.link_target IS NULL AND f.size IN ("+placeholders+") AND "+notGroupedCondition+" ORDER BY f.guid", args...)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	return resultFiles
+	return sizeGroups, nil
 }
 
-func (idx *Index) GetFileByGuid(guid string) *FileItem {
-	return idx.files[guid]
+// Size and hash shared by files made by the same hash algorithm
+type hashGroupKey struct {
+	size int64
+	hash string
 }
 
-func (idx *Index) loadFilesFromDB() error {
-	rows, err := idx.db.Query("SELECT guid, path, extension, size, mod_time, hash, humanized_size FROM files")
+// Selects the files that are in no group of a scan session yet, the session id is the last parameter
+const notGroupedCondition = `NOT EXISTS (
+	SELECT 1 FROM group_members gm INNER JOIN groups gg ON gg.group_id = gm.group_id
+	WHERE gm.guid = f.guid AND gg.session_id = ?)`
+
+// Returns the size and hash of every group of at least two files hashed by the algorithm, largest first.
+// Files already in a group of the scan session are not counted.
+func (idx *Index) GetDuplicateHashes(algorithm string, sessionID int64) ([]hashGroupKey, error) {
+	rows, err := idx.db.Query(`
+		SELECT f.size, f.hash FROM files f
+		WHERE f.hash IS NOT NULL AND f.hash_algorithm = ? AND f.link_target IS NULL AND `+notGroupedCondition+`
+		GROUP BY f.size, f.hash
+		HAVING COUNT(*) > 1
+		ORDER BY f.size DESC, f.hash
+	`, algorithm, sessionID)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to query hash groups: %v", err)
 	}
 	defer rows.Close()
 
+	var keys []hashGroupKey
 	for rows.Next() {
-		var file FileItem
-		var hash sql.NullString
-		err := rows.Scan(&file.Guid, &file.Path, &file.Extension, &file.Size, &file.ModTime, &hash, &file.HumanizedSize)
-		if err != nil {
-			return err
+		var key hashGroupKey
+		if err := rows.Scan(&key.size, &key.hash); err != nil {
+			return nil, fmt.Errorf("failed to scan hash group: %v", err)
 		}
-		file.Hash = hash
-		idx.files[file.Guid] = &file
+		keys = append(keys, key)
 	}
+	return keys, rows.Err()
+}
 
-	return rows.Err()
+// Returns the files of one hash group, see GetDuplicateHashes
+func (idx *Index) GetFilesByHash(size int64, hash, algorithm string, sessionID int64) ([]*FileItem, error) {
+	var files []*FileItem
+	err := idx.forEachFile(func(file *FileItem) error {
+		files = append(files, file)
+		return nil
+	}, `
+		SELECT `+fileColumns+` FROM files f
+		WHERE f.hash = ? AND f.hash_algorithm = ? AND f.size = ? AND f.link_target IS NULL AND `+notGroupedCondition+`
+		ORDER BY f.guid
+	`, hash, algorithm, size, sessionID)
+	return files, err
 }
 
 func (idx *Index) Close() error {
@@ -269,7 +486,7 @@ func (idx *Index) AddFile(path string) error {
 
 	// Check if file with same path and modTime already exists and is similar
 	// This is a simple check; more complex logic could compare hashes if sizes match
-	if existingFile, exists := idx.files[guid]; exists {
+	if existingFile := idx.GetFileByGuid(guid); existingFile != nil {
 		if existingFile.Size == fileInfo.Size() && existingFile.ModTime == modTime {
 			// fmt.Printf("Skipping unchanged file: %s\n", path) // Can be verbose
 			return nil // Skip if path, size, and modTime match
@@ -287,122 +504,14 @@ func (idx *Index) AddFile(path string) error {
 		Hash:          sql.NullString{String: "", Valid: false}, // Hash will be calculated on demand or during scan
 	}
 
-	// add to index
-	idx.files[guid] = file
-
 	// add to database
 	_, err = idx.db.Exec(
-		"INSERT OR REPLACE INTO files (guid, path, extension, size, mod_time, hash, humanized_size) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		upsertFileQuery,
 		file.Guid, file.Path, file.Extension, file.Size, file.ModTime, file.Hash, file.HumanizedSize,
 	)
 	return err
 }
 
-// Todo: move the file retrieval outside this function
-// Here we just add the files to the index
-func (idx *Index) AddDirectory(dirPath string, recursive bool, filter string) error {
-	fileInfo, err := os.Stat(dirPath)
-	if err != nil {
-		return err
-	}
-	if !fileInfo.IsDir() {
-		return fmt.Errorf("%s is not a directory", dirPath)
-	}
-
-	// Begin transaction
-	tx, err := idx.db.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction for AddDirectory: %v", err)
-	}
-	defer tx.Rollback() // Rollback if not committed
-
-	// Prepare statement for batch inserts
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO files (guid, path, extension, size, mod_time, hash, humanized_size) VALUES (?, ?, ?, ?, ?, ?, ?)")
-	if err != nil {
-		return fmt.Errorf("failed to prepare insert statement for AddDirectory: %v", err)
-	}
-	defer stmt.Close()
-
-	walkFunc := func(path string, info os.FileInfo, errWalk error) error {
-		if errWalk != nil {
-			fmt.Printf("Warning: Error accessing %s: %v\n", path, errWalk)
-			return nil
-		}
-		if info.IsDir() {
-			if !recursive && path != dirPath {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		// is a filter set? check for it
-		if filter != "" {
-			matched, errMatch := filepath.Match(filter, filepath.Base(path))
-			if errMatch != nil {
-				fmt.Printf("Warning: Error matching filter for %s: %v\n", path, errMatch)
-				return errMatch // Propagate match error
-			}
-			if !matched {
-				return nil
-			}
-		}
-
-		// Check minimum file size
-		minFileSize := idx.config.MinFileSize
-		if minFileSize > 0 && info.Size() < minFileSize {
-			return nil
-		}
-
-		// get file info
-		guid := filepath.Clean(path)
-		extension := strings.TrimPrefix(filepath.Ext(path), ".")
-		modTime := info.ModTime().Unix()
-
-		// Check if file with same path and modTime already exists and is similar
-		if existingFile, exists := idx.files[guid]; exists {
-			if existingFile.Size == info.Size() && existingFile.ModTime == modTime {
-				return nil // Skip if path, size, and modTime match
-			}
-		}
-
-		// Create new fileitem
-		file := &FileItem{
-			Guid:          guid,
-			Path:          path,
-			Extension:     extension,
-			Size:          info.Size(),
-			HumanizedSize: HumanizeBytes(info.Size()),
-			ModTime:       modTime,
-			Hash:          sql.NullString{String: "", Valid: false}, // Hash will be calculated on demand or during scan
-		}
-
-		// Add to in-memory index
-		idx.files[guid] = file
-
-		// Execute prepared statement
-		_, errExec := stmt.Exec(file.Guid, file.Path, file.Extension, file.Size, file.ModTime, file.Hash, file.HumanizedSize)
-		if errExec != nil {
-			fmt.Printf("Warning: Failed to add %s to database: %v\n", path, errExec)
-		}
-
-		return nil
-	}
-
-	// Walk the directory
-	err = filepath.Walk(dirPath, walkFunc)
-	if err != nil {
-		return fmt.Errorf("error walking directory: %v", err)
-	}
-
-	// Commit transaction
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("failed to commit transaction for AddDirectory: %v", err)
-	}
-
-	return nil
-}
-
 func (idx *Index) AddFileItems(fileItems []*FileItem) error {
 	tx, err := idx.db.Begin()
 	if err != nil {
@@ -410,14 +519,13 @@ func (idx *Index) AddFileItems(fileItems []*FileItem) error {
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("INSERT OR REPLACE INTO files (guid, path, extension, size, mod_time, hash, humanized_size) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare(upsertFileQuery)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
 	for _, file := range fileItems {
-		idx.files[file.Guid] = file
 		stmt.Exec(file.Guid, file.Path, file.Extension, file.Size, file.ModTime, file.Hash, file.HumanizedSize)
 		if idx.config.Debug {
 			fmt.Printf("Debug: Adding %s to index\n", file.Guid)
@@ -428,37 +536,44 @@ func (idx *Index) AddFileItems(fileItems []*FileItem) error {
 }
 
 func (idx *Index) Purge() (int, error) {
-	count := 0
 	guidsToDelete := []string{}
-	for guid, file := range idx.files {
+	err := idx.ForEachFile(func(file *FileItem) error {
 		_, err := os.Stat(file.Path)
 		if os.IsNotExist(err) {
-			guidsToDelete = append(guidsToDelete, guid)
+			guidsToDelete = append(guidsToDelete, file.Guid)
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
+	return idx.RemoveFiles(guidsToDelete)
+}
 
-	if len(guidsToDelete) == 0 {
+// Removes the files from the index and returns how many were removed
+func (idx *Index) RemoveFiles(guids []string) (int, error) {
+	if len(guids) == 0 {
 		return 0, nil
 	}
 
+	count := 0
 	tx, err := idx.db.Begin()
 	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction for purge: %v", err)
+		return 0, fmt.Errorf("failed to begin transaction for remove: %v", err)
 	}
 	defer tx.Rollback() // Rollback if not committed
 
 	stmt, err := tx.Prepare("DELETE FROM files WHERE guid = ?")
 	if err != nil {
-		return 0, fmt.Errorf("failed to prepare delete statement for purge: %v", err)
+		return 0, fmt.Errorf("failed to prepare delete statement for remove: %v", err)
 	}
 	defer stmt.Close()
 
-	for _, guid := range guidsToDelete {
-		delete(idx.files, guid) // Remove from in-memory map
+	for _, guid := range guids {
 		_, errExec := stmt.Exec(guid)
 		if errExec != nil {
 			// Log error and continue, or return immediately depending on desired atomicity
-			fmt.Fprintf(os.Stderr, "Error deleting file %s from database during purge: %v\n", guid, errExec)
+			fmt.Fprintf(os.Stderr, "Error deleting file %s from database: %v\n", guid, errExec)
 			continue // Or return count, errExec
 		}
 		count++
@@ -466,46 +581,100 @@ func (idx *Index) Purge() (int, error) {
 
 	err = tx.Commit()
 	if err != nil {
-		return 0, fmt.Errorf("failed to commit transaction for purge: %v", err)
+		return 0, fmt.Errorf("failed to commit transaction for remove: %v", err)
 	}
 	return count, nil
 }
 
+// Maximum number of parameters of one query, SQLite allows 32766 since 3.32
+const maxQueryParams = 999
+
+// Returns the files that are not in the index yet or whose size or modification time changed.
+// Unchanged files keep their hashes.
+func (idx *Index) changedFileItems(fileItems []*FileItem) ([]*FileItem, error) {
+	type fileState struct{ size, modTime int64 }
+	indexed := make(map[string]fileState, len(fileItems))
+
+	for start := 0; start < len(fileItems); start += maxQueryParams {
+		chunk := fileItems[start:min(start+maxQueryParams, len(fileItems))]
+		args := make([]any, len(chunk))
+		for i, file := range chunk {
+			args[i] = file.Guid
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+
+		rows, err := idx.db.Query("SELECT guid, size, mod_time FROM files WHERE guid IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query files: %v", err)
+		}
+		for rows.Next() {
+			var guid string
+			var state fileState
+			if err := rows.Scan(&guid, &state.size, &state.modTime); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan file row: %v", err)
+			}
+			indexed[guid] = state
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var changed []*FileItem
+	for _, file := range fileItems {
+		if state, ok := indexed[file.Guid]; ok && state.size == file.Size && state.modTime == file.ModTime {
+			continue
+		}
+		changed = append(changed, file)
+	}
+	return changed, nil
+}
+
 func (idx *Index) Update() (int, error) {
 	count := 0
 	filesToUpdateInDB := []*FileItem{}
 	guidsToDelete := []string{}
 
-	for _, file := range idx.files {
+	err := idx.ForEachFile(func(file *FileItem) error {
 		fileInfo, err := os.Stat(file.Path)
 		if os.IsNotExist(err) {
 			guidsToDelete = append(guidsToDelete, file.Guid)
-			continue
+			return nil
 		}
 		if err != nil {
 			fmt.Printf("Warning: Error accessing %s during update: %v\n", file.Path, err)
-			continue
+			return nil
 		}
 
 		newModTime := fileInfo.ModTime().Unix()
 		if fileInfo.Size() != file.Size || newModTime != file.ModTime {
 			file.Size = fileInfo.Size()
 			file.ModTime = newModTime
+			file.PartialHash = sql.NullString{String: "", Valid: false}
 
 			// Invalidate old hash and recalculate
 			// The CalculateHash method now only returns hash string and error
-			newHashString, errHash := CalculateFileHash(file.Path, file.Size)
+			newHashString, errHash := CalculateFileHash(file.Path, idx.hasher)
 
 			if errHash != nil {
 				fmt.Printf("Warning: Failed to calculate hash for updated file %s: %v\n", file.Path, errHash)
 				file.Hash = sql.NullString{String: "", Valid: false}
+				file.HashAlgorithm = sql.NullString{String: "", Valid: false}
 			} else {
 				file.Hash = sql.NullString{String: newHashString, Valid: true}
+				file.HashAlgorithm = sql.NullString{String: idx.hasher.Name(), Valid: true}
 			}
 			filesToUpdateInDB = append(filesToUpdateInDB, file)
 			count++
 			fmt.Printf("Marked for update: %s (new size: %d, new mod_time: %d)\n", file.Path, file.Size, file.ModTime)
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
 	// Perform deletions
@@ -520,7 +689,6 @@ func (idx *Index) Update() (int, error) {
 			return count, fmt.Errorf("update: failed to prepare delete statement: %v", err)
 		}
 		for _, guid := range guidsToDelete {
-			delete(idx.files, guid)
 			if _, errExec := stmtDel.Exec(guid); errExec != nil {
 				fmt.Fprintf(os.Stderr, "Warning: failed to delete %s during update: %v\n", guid, errExec)
 			}
@@ -538,13 +706,13 @@ func (idx *Index) Update() (int, error) {
 		if err != nil {
 			return count, fmt.Errorf("update: failed to begin update transaction: %v", err)
 		}
-		stmtUpd, err := txUpd.Prepare("UPDATE files SET size = ?, hash = ?, mod_time = ? WHERE guid = ?")
+		stmtUpd, err := txUpd.Prepare("UPDATE files SET size = ?, hash = ?, hash_algorithm = ?, mod_time = ?, partial_hash = NULL WHERE guid = ?")
 		if err != nil {
 			txUpd.Rollback()
 			return count, fmt.Errorf("update: failed to prepare update statement: %v", err)
 		}
 		for _, fileToUpdate := range filesToUpdateInDB {
-			if _, errExec := stmtUpd.Exec(fileToUpdate.Size, fileToUpdate.Hash, fileToUpdate.ModTime, fileToUpdate.Guid); errExec != nil {
+			if _, errExec := stmtUpd.Exec(fileToUpdate.Size, fileToUpdate.Hash, fileToUpdate.HashAlgorithm, fileToUpdate.ModTime, fileToUpdate.Guid); errExec != nil {
 				fmt.Fprintf(os.Stderr, "Warning: failed to update %s during update: %v\n", fileToUpdate.Guid, errExec)
 			}
 		}
@@ -558,14 +726,12 @@ func (idx *Index) Update() (int, error) {
 
 // Delete all known duplicates
 func (idx *Index) ForgetDuplicates() error {
-	result, err := idx.db.Exec(
-		// 			stmt, err := tx.Prepare(`
-		//               INSERT INTO duplicates (guid, scanned)
-		//               VALUES (?, ?)
-		//               ON CONFLICT(guid) DO UPDATE SET scanned = ?
-		//           `)
-		"DELETE from duplicates",
-	)
+	// the scan sessions keep their groups, only the current duplicates are forgotten
+	result, err := idx.db.Exec(`
+		UPDATE group_members SET removed_at = ?
+		WHERE removed_at IS NULL
+			AND group_id IN (SELECT g.group_id FROM groups g WHERE `+currentGroupsCondition+`)
+	`, time.Now().Unix())
 	if err != nil {
 		return fmt.Errorf("failed to forget duplicates: %v", err)
 	}
@@ -582,7 +748,7 @@ func (idx *Index) ForgetDuplicates() error {
 // Delete all calculated hash values
 func (idx *Index) ForgetHashes() error {
 	result, err := idx.db.Exec(
-		"UPDATE files SET hash = NULL WHERE hash IS NOT NULL",
+		"UPDATE files SET hash = NULL, hash_algorithm = NULL, partial_hash = NULL WHERE hash IS NOT NULL OR partial_hash IS NOT NULL",
 	)
 	if err != nil {
 		return fmt.Errorf("failed to forget hashes: %v", err)
@@ -0,0 +1,390 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Actions recorded in the journal
+const (
+	ActionMove     = "move"
+	ActionTrash    = "trash"
+	ActionHardlink = "hardlink"
+	ActionSymlink  = "symlink"
+	ActionReflink  = "reflink"
+)
+
+// One file changed by a destructive action
+type JournalEntry struct {
+	ID            int64
+	OperationID   string
+	Action        string
+	OriginalPath  string         // Where the file lived before the action
+	NewPath       string         // Where the file is now, for links the kept file they point to
+	Hash          sql.NullString // Hash of the file content at the time of the action
+	HashAlgorithm sql.NullString
+	Timestamp     int64
+	Undone        bool
+}
+
+// Summary of all journal entries of one operation
+type OperationSummary struct {
+	OperationID string
+	Action      string
+	Timestamp   int64
+	FileCount   int
+	UndoneCount int
+}
+
+func (idx *Index) AddJournalEntry(entry *JournalEntry) error {
+	_, err := idx.db.Exec(`
+		INSERT INTO journal (operation_id, action, original_path, new_path, hash, hash_algorithm, timestamp, undone)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0)
+	`, entry.OperationID, entry.Action, entry.OriginalPath, entry.NewPath, entry.Hash, entry.HashAlgorithm, entry.Timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to add journal entry: %v", err)
+	}
+	return nil
+}
+
+// Returns the journal entries of the operation. The operation id may be shortened, as long as it is unique.
+func (idx *Index) GetJournalEntries(operationID string) ([]*JournalEntry, error) {
+	var matches int
+	err := idx.db.QueryRow("SELECT COUNT(DISTINCT operation_id) FROM journal WHERE operation_id LIKE ? || '%'", operationID).Scan(&matches)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query journal: %v", err)
+	}
+	if matches == 0 {
+		return nil, fmt.Errorf("no operation %s in the journal", operationID)
+	}
+	if matches > 1 {
+		return nil, fmt.Errorf("operation id %s is ambiguous, %d operations match", operationID, matches)
+	}
+
+	rows, err := idx.db.Query(`
+		SELECT id, operation_id, action, original_path, new_path, hash, hash_algorithm, timestamp, undone
+		FROM journal
+		WHERE operation_id LIKE ? || '%'
+		ORDER BY id
+	`, operationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query journal: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []*JournalEntry
+	for rows.Next() {
+		var entry JournalEntry
+		err := rows.Scan(&entry.ID, &entry.OperationID, &entry.Action, &entry.OriginalPath, &entry.NewPath,
+			&entry.Hash, &entry.HashAlgorithm, &entry.Timestamp, &entry.Undone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan journal entry: %v", err)
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// Returns all operations in the journal, newest first
+func (idx *Index) GetOperations() ([]*OperationSummary, error) {
+	rows, err := idx.db.Query(`
+		SELECT operation_id, action, MIN(timestamp), COUNT(*), SUM(undone)
+		FROM journal
+		GROUP BY operation_id, action
+		ORDER BY MIN(timestamp) DESC, MIN(id) DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query journal: %v", err)
+	}
+	defer rows.Close()
+
+	var operations []*OperationSummary
+	for rows.Next() {
+		var operation OperationSummary
+		err := rows.Scan(&operation.OperationID, &operation.Action, &operation.Timestamp, &operation.FileCount, &operation.UndoneCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan operation: %v", err)
+		}
+		operations = append(operations, &operation)
+	}
+	return operations, rows.Err()
+}
+
+// Returns the latest entry of the action that is not undone and put a file at newPath, nil if there is none
+func (idx *Index) FindJournalEntry(action, newPath string) (*JournalEntry, error) {
+	var entry JournalEntry
+	err := idx.db.QueryRow(`
+		SELECT id, operation_id, action, original_path, new_path, hash, hash_algorithm, timestamp, undone
+		FROM journal
+		WHERE action = ? AND new_path = ? AND undone = 0
+		ORDER BY id DESC
+		LIMIT 1
+	`, action, newPath).Scan(&entry.ID, &entry.OperationID, &entry.Action, &entry.OriginalPath, &entry.NewPath,
+		&entry.Hash, &entry.HashAlgorithm, &entry.Timestamp, &entry.Undone)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query journal: %v", err)
+	}
+	return &entry, nil
+}
+
+func (idx *Index) MarkJournalEntryUndone(id int64) error {
+	_, err := idx.db.Exec("UPDATE journal SET undone = 1 WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to update journal entry: %v", err)
+	}
+	return nil
+}
+
+// A running destructive action. Every changed file gets recorded in the journal right away,
+// so an interrupted action can be undone as well.
+type operation struct {
+	index  *Index
+	id     string
+	action string
+	count  int
+}
+
+func (a *App) newOperation(action string) *operation {
+	return &operation{index: a.index, id: generateGUID(), action: action}
+}
+
+// Records that file was moved from originalPath to newPath, or replaced by a link to newPath
+func (o *operation) record(file *FileItem, originalPath, newPath string) {
+	err := o.index.AddJournalEntry(&JournalEntry{
+		OperationID:   o.id,
+		Action:        o.action,
+		OriginalPath:  originalPath,
+		NewPath:       newPath,
+		Hash:          file.Hash,
+		HashAlgorithm: file.HashAlgorithm,
+		Timestamp:     time.Now().Unix(),
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		return
+	}
+	o.count++
+}
+
+// Shows how to undo the operation
+func (o *operation) finish() {
+	if o.count == 0 {
+		return
+	}
+	if !undoable(o.action) {
+		fmt.Printf("Operation %s (not undoable)\n", o.id)
+		return
+	}
+	fmt.Printf("Operation %s (undo with --undo %s)\n", o.id, o.id)
+}
+
+// Reflinked files are independent files with the same content already, there is nothing to restore
+func undoable(action string) bool {
+	return action != ActionReflink
+}
+
+// Lists all operations in the journal
+func (a *App) ShowHistory() {
+	operations, err := a.index.GetOperations()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(operations) == 0 {
+		fmt.Println("No operations in journal")
+		return
+	}
+
+	for _, operation := range operations {
+		status := ""
+		if !undoable(operation.Action) {
+			status = " (not undoable)"
+		} else if operation.UndoneCount == operation.FileCount {
+			status = " (undone)"
+		} else if operation.UndoneCount > 0 {
+			status = fmt.Sprintf(" (%d undone)", operation.UndoneCount)
+		}
+		fmt.Printf("%s  %s  %-8s %d files%s\n", operation.OperationID,
+			time.Unix(operation.Timestamp, 0).Format("2006-01-02 15:04:05"), operation.Action, operation.FileCount, status)
+	}
+	fmt.Printf("Operations in journal: %d total.\n", len(operations))
+}
+
+// Restores the files of an operation to their original locations
+func (a *App) Undo(operationID string) {
+	if operationID == "" {
+		fmt.Fprintf(os.Stderr, "Error: No operation id specified\n")
+		os.Exit(1)
+	}
+
+	entries, err := a.index.GetJournalEntries(operationID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !undoable(entries[0].Action) {
+		fmt.Printf("Operation %s (%s) can not be undone, the files are independent files already\n", entries[0].OperationID, entries[0].Action)
+		return
+	}
+
+	restoredCount := 0
+	// undo in reverse order, in case a file was touched twice
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Undone {
+			continue
+		}
+
+		if a.config.DryRun {
+			fmt.Printf("Would restore %s (%s)\n", entry.OriginalPath, entry.Action)
+			continue
+		}
+
+		switch entry.Action {
+		case ActionMove, ActionTrash:
+			err = a.undoMove(entry)
+		case ActionHardlink, ActionSymlink:
+			err = a.undoLink(entry)
+		default:
+			err = fmt.Errorf("unknown action %s", entry.Action)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error restoring %s: %v\n", entry.OriginalPath, err)
+			continue
+		}
+
+		if err := a.index.MarkJournalEntryUndone(entry.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		restoredCount++
+	}
+
+	fmt.Printf("Restored %d of %d files of operation %s\n", restoredCount, len(entries), entries[0].OperationID)
+}
+
+// Moves a file back to its original location
+func (a *App) undoMove(entry *JournalEntry) error {
+	if _, err := os.Lstat(entry.OriginalPath); err == nil {
+		return fmt.Errorf("original path exists already")
+	}
+	if err := verifyJournalHash(entry.NewPath, entry); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(entry.OriginalPath), 0755); err != nil {
+		return err
+	}
+	if err := moveFile(entry.NewPath, entry.OriginalPath, entry.Hash, entry.HashAlgorithm); err != nil {
+		return err
+	}
+	if entry.Action == ActionTrash && freeDesktopTrash {
+		os.Remove(trashInfoPathFor(entry.NewPath))
+	}
+
+	if entry.Action == ActionTrash {
+		a.reindexRestoredFile(entry.OriginalPath)
+	} else if file := a.index.GetFileByGuid(filepath.Clean(entry.NewPath)); file != nil {
+		if err := a.index.UpdateFilePath(file, entry.OriginalPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating database for %s: %v\n", entry.OriginalPath, err)
+		}
+	}
+	return nil
+}
+
+// Replaces a link with an independent copy of the file it points to
+func (a *App) undoLink(entry *JournalEntry) error {
+	if err := verifyJournalHash(entry.NewPath, entry); err != nil {
+		return err
+	}
+	if err := a.verifyJournalLink(entry); err != nil {
+		return err
+	}
+
+	err := replaceFile(entry.OriginalPath, func(tempPath string) error {
+		return copyFile(entry.NewPath, tempPath)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := a.index.ClearLinkTarget(filepath.Clean(entry.OriginalPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating database for %s: %v\n", entry.OriginalPath, err)
+	}
+	return nil
+}
+
+// Checks that the original path is still the link the operation created. Anything else was put there
+// after the operation and must not be overwritten by the copy.
+func (a *App) verifyJournalLink(entry *JournalEntry) error {
+	info, err := os.Lstat(entry.OriginalPath)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Action {
+	case ActionHardlink:
+		keepInfo, err := os.Stat(entry.NewPath)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || !os.SameFile(info, keepInfo) {
+			return fmt.Errorf("%s is no hard link to %s anymore", entry.OriginalPath, entry.NewPath)
+		}
+	case ActionSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%s is no symbolic link anymore", entry.OriginalPath)
+		}
+		target, err := os.Readlink(entry.OriginalPath)
+		if err != nil {
+			return err
+		}
+		// the index knows the target the link was created with, older entries are compared with the kept file
+		if file := a.index.GetFileByGuid(filepath.Clean(entry.OriginalPath)); file != nil && file.LinkTarget.Valid {
+			if target != file.LinkTarget.String {
+				return fmt.Errorf("%s points to %s instead of %s", entry.OriginalPath, target, file.LinkTarget.String)
+			}
+			return nil
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(entry.OriginalPath), target)
+		}
+		absTarget, err := filepath.Abs(target)
+		if err != nil {
+			return err
+		}
+		absKeep, err := filepath.Abs(entry.NewPath)
+		if err != nil {
+			return err
+		}
+		if absTarget != absKeep {
+			return fmt.Errorf("%s points to %s instead of %s", entry.OriginalPath, target, entry.NewPath)
+		}
+	}
+	return nil
+}
+
+// Checks that the file at path still has the content recorded in the journal
+func verifyJournalHash(path string, entry *JournalEntry) error {
+	if !entry.Hash.Valid {
+		return fmt.Errorf("no hash recorded")
+	}
+	hasher, err := GetHasher(entry.HashAlgorithm.String)
+	if err != nil {
+		return err
+	}
+	hash, err := CalculateFileHash(path, hasher)
+	if err != nil {
+		return err
+	}
+	if hash != entry.Hash.String {
+		return fmt.Errorf("%s was changed after the operation", path)
+	}
+	return nil
+}
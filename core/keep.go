@@ -0,0 +1,248 @@
+package core
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A rule compares two copies of a duplicate group.
+// A negative result means a should rather be kept than b, 0 leaves the decision to the next rule.
+type keepRule func(p *KeepPolicy, a, b *FileItem) int
+
+var keepRules = map[string]keepRule{
+	"oldest": func(p *KeepPolicy, a, b *FileItem) int {
+		return cmp.Compare(a.ModTime, b.ModTime)
+	},
+	"newest": func(p *KeepPolicy, a, b *FileItem) int {
+		return cmp.Compare(b.ModTime, a.ModTime)
+	},
+	"shortest-path": func(p *KeepPolicy, a, b *FileItem) int {
+		return cmp.Compare(len(a.Path), len(b.Path))
+	},
+	"longest-path": func(p *KeepPolicy, a, b *FileItem) int {
+		return cmp.Compare(len(b.Path), len(a.Path))
+	},
+	"prefer": func(p *KeepPolicy, a, b *FileItem) int {
+		return cmp.Compare(p.preferRank(a), p.preferRank(b))
+	},
+	"never": func(p *KeepPolicy, a, b *FileItem) int {
+		return compareBool(p.NeverTouch(a), p.NeverTouch(b))
+	},
+	"most-links": func(p *KeepPolicy, a, b *FileItem) int {
+		return cmp.Compare(p.linkCount(b), p.linkCount(a))
+	},
+}
+
+// Returns the names of all keep rules
+func KeepRuleNames() []string {
+	names := make([]string, 0, len(keepRules))
+	for name := range keepRules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// KeepPolicy decides which copy of a duplicate group is kept by every action.
+// A copy under a protected root is always the kept one, after that the rules are applied
+// in order, each one only breaks the ties of the rules before.
+// Files under protected roots or matching a never touch pattern are never touched.
+type KeepPolicy struct {
+	ruleNames      []string
+	rules          []keepRule
+	preferDirs     []string
+	neverTouch     []string
+	protectedRoots []string
+	linkCounts     map[string]uint64 // Cache of hard link counts by path
+}
+
+// Creates the policy from the configuration. protectedRoots are added to the protected roots of the configuration.
+func NewKeepPolicy(config *Config, protectedRoots []string) (*KeepPolicy, error) {
+	policy := &KeepPolicy{
+		ruleNames:  config.KeepRules,
+		neverTouch: config.KeepNeverTouch,
+		linkCounts: make(map[string]uint64),
+	}
+
+	for _, name := range config.KeepRules {
+		rule, ok := keepRules[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown keep rule %q (available: %s)", name, strings.Join(KeepRuleNames(), ", "))
+		}
+		policy.rules = append(policy.rules, rule)
+	}
+
+	for _, pattern := range config.KeepNeverTouch {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid never touch pattern %q: %v", pattern, err)
+		}
+	}
+
+	for _, dir := range config.KeepPreferDirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		policy.preferDirs = append(policy.preferDirs, absDir)
+	}
+
+	for _, root := range append(slices.Clone(config.ProtectedRoots), protectedRoots...) {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		policy.protectedRoots = append(policy.protectedRoots, absRoot)
+	}
+
+	return policy, nil
+}
+
+// Returns the rules of the policy, or "first path" if none are configured
+func (p *KeepPolicy) String() string {
+	if len(p.ruleNames) == 0 {
+		return "first path"
+	}
+	return strings.Join(p.ruleNames, ", ")
+}
+
+// Splits a duplicate group into the copy to keep and the copies actions may touch
+func (p *KeepPolicy) Select(group []*FileItem) (keep *FileItem, rest []*FileItem) {
+	if len(group) == 0 {
+		return nil, nil
+	}
+
+	sorted := slices.Clone(group)
+	slices.SortStableFunc(sorted, func(a, b *FileItem) int {
+		if result := compareBool(p.Protected(a), p.Protected(b)); result != 0 {
+			return result
+		}
+		for _, rule := range p.rules {
+			if result := rule(p, a, b); result != 0 {
+				return result
+			}
+		}
+		// without a decision keep the first path
+		return cmp.Compare(a.Guid, b.Guid)
+	})
+
+	for _, file := range sorted[1:] {
+		if !p.NeverTouch(file) && !p.Protected(file) {
+			rest = append(rest, file)
+		}
+	}
+	return sorted[0], rest
+}
+
+// Checks if the file is under one of the protected roots
+func (p *KeepPolicy) Protected(file *FileItem) bool {
+	absPath, err := filepath.Abs(file.Path)
+	if err != nil {
+		// better safe than sorry
+		return len(p.protectedRoots) > 0
+	}
+	for _, root := range p.protectedRoots {
+		if isPathUnder(absPath, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the protected roots of the configuration and the index
+func (p *KeepPolicy) ProtectedRoots() []string {
+	return p.protectedRoots
+}
+
+// Checks if the file matches one of the never touch patterns, either with its name or its full path
+func (p *KeepPolicy) NeverTouch(file *FileItem) bool {
+	for _, pattern := range p.neverTouch {
+		if matched, _ := filepath.Match(pattern, filepath.Base(file.Path)); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, file.Path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the position of the first preferred directory containing the file, files outside rank last
+func (p *KeepPolicy) preferRank(file *FileItem) int {
+	absPath, err := filepath.Abs(file.Path)
+	if err != nil {
+		return len(p.preferDirs)
+	}
+	for i, dir := range p.preferDirs {
+		if isPathUnder(absPath, dir) {
+			return i
+		}
+	}
+	return len(p.preferDirs)
+}
+
+// Checks if path is dir or inside of dir. Both paths must be absolute.
+func isPathUnder(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func (p *KeepPolicy) linkCount(file *FileItem) uint64 {
+	if count, ok := p.linkCounts[file.Path]; ok {
+		return count
+	}
+	count, err := linkCount(file.Path)
+	if err != nil {
+		count = 0
+	}
+	p.linkCounts[file.Path] = count
+	return count
+}
+
+// Sorts true before false
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// A duplicate group split by the keep policy
+type keepDecision struct {
+	keep *FileItem   // The copy that is kept, links point to it
+	rest []*FileItem // The copies actions may replace, move or delete
+}
+
+// Returns the keep decision for every duplicate group in the index.
+// Groups without any copy an action may touch are skipped and the reason is shown.
+func (a *App) decideDuplicateGroups() []keepDecision {
+	var decisions []keepDecision
+	for _, group := range a.index.GetDuplicateFileGroups() {
+		keep, rest := a.keepPolicy.Select(group)
+		if len(rest) == 0 {
+			fmt.Printf("Skipping group of %s (%d files): %s\n", keep.Path, len(group), a.keepPolicy.skipReason(group))
+			continue
+		}
+		decisions = append(decisions, keepDecision{keep: keep, rest: rest})
+	}
+	return decisions
+}
+
+// Explains why no copy of the group may be touched
+func (p *KeepPolicy) skipReason(group []*FileItem) string {
+	protected := 0
+	for _, file := range group {
+		if p.Protected(file) {
+			protected++
+		}
+	}
+	if protected == len(group) {
+		return "all copies are under protected roots"
+	}
+	return "all other copies are protected or match a never touch pattern"
+}
@@ -0,0 +1,230 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+)
+
+const DefaultLockstepMaxFiles = 3
+
+// Size of the blocks the lockstep comparison reads from every file at a time
+const lockstepBlockSize = 64 * 1024 // 64KB
+
+// A file read by the lockstep comparison
+type lockstepFile struct {
+	item *FileItem
+	file *os.File
+	hash hash.Hash
+	buf  []byte
+	n    int // Bytes of the last block in buf
+}
+
+// ScanByLockstep compares the size groups of at most LockstepMaxFiles files with the lockstep comparison,
+// instead of hashing them and comparing them again afterwards. The classes of identical files are returned
+// as results, they are stored with their hashes after every checkpoint. Returns the size groups that are left
+// to the hash stages. When the scan is interrupted, the results of the finished checkpoints are returned.
+func (s *Scanner) ScanByLockstep(sizeGroups map[int64][]*FileItem) (map[int64][]*FileItem, []*ResultList) {
+	maxFiles := s.idx.config.LockstepMaxFiles
+	if maxFiles < 2 {
+		return sizeGroups, nil
+	}
+
+	remaining := make(map[int64][]*FileItem)
+	var groups [][]*FileItem
+	for size, filesInGroup := range sizeGroups {
+		if len(filesInGroup) < 2 {
+			continue
+		}
+		if len(filesInGroup) > maxFiles {
+			remaining[size] = filesInGroup
+			continue
+		}
+		groups = append(groups, filesInGroup)
+	}
+	if len(groups) == 0 {
+		return remaining, nil
+	}
+
+	if s.idx.config.Debug {
+		fmt.Printf("  Comparing %d size groups in lockstep...\n", len(groups))
+	}
+
+	var results []*ResultList
+	for start := 0; start < len(groups) && s.ctx.Err() == nil; {
+		// a checkpoint has about checkpointFiles files or checkpointBytes bytes, like in the hash stage
+		end := start
+		files, size := 0, int64(0)
+		for end < len(groups) && files < checkpointFiles && size < checkpointBytes {
+			files += len(groups[end])
+			size += groups[end][0].Size * int64(len(groups[end]))
+			end++
+		}
+		checkpoint := groups[start:end]
+		start = end
+
+		// all files of a group are read at the same time, a group holds a worker of each of their devices
+		var checkpointResults []*ResultList
+		var hashesToUpdate []struct{ guid, hash string }
+		var mu sync.Mutex
+		s.devices.run(len(checkpoint), func(i int) []string { return filePaths(checkpoint[i]) }, func(i int) {
+			if s.ctx.Err() != nil {
+				return
+			}
+			classes := s.lockstepClasses(checkpoint[i])
+			mu.Lock()
+			defer mu.Unlock()
+			for _, class := range classes {
+				checkpointResults = append(checkpointResults, class.result)
+				hashesToUpdate = append(hashesToUpdate, class.hashes...)
+			}
+		})
+
+		if err := s.updateHashesInIndex(hashesToUpdate); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+		for _, result := range checkpointResults {
+			if err := s.addDuplicatesToIndex(result); err != nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		}
+		results = append(results, checkpointResults...)
+	}
+	return remaining, results
+}
+
+// A class of identical files found by the lockstep comparison
+type lockstepClass struct {
+	result *ResultList
+	hashes []struct{ guid, hash string }
+}
+
+// Runs the lockstep comparison on one size group and turns its classes into results
+func (s *Scanner) lockstepClasses(filesInGroup []*FileItem) []lockstepClass {
+	classes, err := readLockstep(s.ctx, filesInGroup, s.idx.hasher)
+	if err != nil && !errors.Is(err, s.ctx.Err()) {
+		fmt.Printf("  Warning: %v\n", err)
+	}
+
+	var lockstepClasses []lockstepClass
+	for _, class := range classes {
+		var duplicateGuids []string
+		var hashes []struct{ guid, hash string }
+		for _, file := range class {
+			duplicateGuids = append(duplicateGuids, file.item.Guid)
+			hashes = append(hashes, struct{ guid, hash string }{file.item.Guid, hex.EncodeToString(file.hash.Sum(nil))})
+		}
+		lockstepClasses = append(lockstepClasses, lockstepClass{
+			result: &ResultList{
+				HashSum:       hashes[0].hash,
+				HashAlgorithm: s.idx.hasher.Name(),
+				Size:          class[0].item.Size,
+				Method:        VerifyFull,
+				FileGuids:     duplicateGuids,
+			},
+			hashes: hashes,
+		})
+	}
+	return lockstepClasses
+}
+
+// Reads the files of a size group block by block at the same time and splits them into classes of identical
+// files as soon as their blocks differ. Files without another file of the same content are dropped right away,
+// so most of them are read only up to their first different block. Files read to the end get hashed on the way.
+// Returns the classes of at least two identical files. Files that fail to open or read are left out,
+// the first error is returned. When the context is cancelled, the classes read to the end so far are returned.
+func readLockstep(ctx context.Context, filesInGroup []*FileItem, hasher Hasher) ([][]*lockstepFile, error) {
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var open []*lockstepFile
+	defer func() {
+		for _, file := range open {
+			file.file.Close()
+		}
+	}()
+	for _, item := range filesInGroup {
+		f, err := os.Open(item.Path)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		open = append(open, &lockstepFile{item: item, file: f, hash: hasher.New(), buf: make([]byte, lockstepBlockSize)})
+	}
+
+	classes := [][]*lockstepFile{open}
+	var done [][]*lockstepFile
+	for len(classes) > 0 {
+		if err := ctx.Err(); err != nil {
+			return done, err
+		}
+		var next [][]*lockstepFile
+		for _, class := range classes {
+			// read the next block of every file of the class
+			var read []*lockstepFile
+			for _, file := range class {
+				n, err := io.ReadFull(file.file, file.buf)
+				if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+					fail(fmt.Errorf("failed to read %s: %w", file.item.Path, err))
+					continue
+				}
+				file.n = n
+				file.hash.Write(file.buf[:n])
+				read = append(read, file)
+			}
+
+			// split the class by the content of the block, classes of a single file are dropped
+			for _, sub := range splitByBlock(read) {
+				if len(sub) < 2 {
+					continue
+				}
+				if sub[0].n < lockstepBlockSize {
+					done = append(done, sub) // end of the files
+				} else {
+					next = append(next, sub)
+				}
+			}
+		}
+		classes = next
+	}
+
+	return done, firstErr
+}
+
+// Splits files into groups with the same last block, in the order of the files
+func splitByBlock(files []*lockstepFile) [][]*lockstepFile {
+	var groups [][]*lockstepFile
+	for _, file := range files {
+		found := false
+		for i, group := range groups {
+			if group[0].n == file.n && bytes.Equal(group[0].buf[:group[0].n], file.buf[:file.n]) {
+				groups[i] = append(group, file)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, []*lockstepFile{file})
+		}
+	}
+	return groups
+}
+
+// Returns the paths of the files
+func filePaths(files []*FileItem) []string {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Path
+	}
+	return paths
+}
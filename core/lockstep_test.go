@@ -0,0 +1,119 @@
+package core
+
+import (
+	"context"
+	"encoding/hex"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Returns the names of the files of every class, the classes sorted by their first file
+func lockstepNames(classes [][]*lockstepFile) [][]string {
+	var names [][]string
+	for _, class := range classes {
+		var classNames []string
+		for _, file := range class {
+			classNames = append(classNames, filepath.Base(file.item.Path))
+		}
+		slices.Sort(classNames)
+		names = append(names, classNames)
+	}
+	slices.SortFunc(names, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	return names
+}
+
+func TestReadLockstep(t *testing.T) {
+	// the files span several blocks, so classes split in the middle and at the end of the files
+	block := strings.Repeat("x", lockstepBlockSize)
+	same := block + block + "same end"
+	tests := []struct {
+		name     string
+		contents map[string]string
+		want     [][]string
+		wantErr  bool
+	}{
+		{
+			name:     "first file differs",
+			contents: map[string]string{"a": block + "other" + block, "b": same, "c": same, "d": same},
+			want:     [][]string{{"b", "c", "d"}},
+		},
+		{
+			name:     "first file missing",
+			contents: map[string]string{"b": same, "c": same, "d": same},
+			want:     [][]string{{"b", "c", "d"}},
+			wantErr:  true,
+		},
+		{
+			name:     "class of three and a single file",
+			contents: map[string]string{"a": same, "b": same, "c": block + block + "diff end", "d": same},
+			want:     [][]string{{"a", "b", "d"}},
+		},
+		{
+			name:     "two classes",
+			contents: map[string]string{"a": block + "first", "b": block + "other", "c": block + "first", "d": block + "other"},
+			want:     [][]string{{"a", "c"}, {"b", "d"}},
+		},
+		{
+			name:     "different lengths with the same prefix",
+			contents: map[string]string{"a": same, "b": same + block, "c": same, "d": block},
+			want:     [][]string{{"a", "c"}},
+		},
+		{
+			name:     "lengths of whole blocks",
+			contents: map[string]string{"a": block, "b": block + block, "c": block, "d": block + block},
+			want:     [][]string{{"a", "c"}, {"b", "d"}},
+		},
+	}
+
+	hasher, err := GetHasher(DefaultHashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := writeTestFiles(t, []string{"a", "b", "c", "d"}, test.contents)
+			classes, err := readLockstep(context.Background(), files, hasher)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error: %v", err, test.wantErr)
+			}
+			if got := lockstepNames(classes); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got classes %v, want %v", got, test.want)
+			}
+
+			// the files read to the end are hashed on the way
+			for _, class := range classes {
+				for _, file := range class {
+					want, err := CalculateFileHash(file.item.Path, hasher)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := hex.EncodeToString(file.hash.Sum(nil)); got != want {
+						t.Errorf("got hash %s for %s, want %s", got, filepath.Base(file.item.Path), want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadLockstepCancelled(t *testing.T) {
+	hasher, err := GetHasher(DefaultHashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := strings.Repeat("x", 2*lockstepBlockSize)
+	files := writeTestFiles(t, []string{"a", "b"}, map[string]string{"a": same, "b": same})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	classes, err := readLockstep(ctx, files, hasher)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if len(classes) != 0 {
+		t.Errorf("got classes %v of a cancelled comparison", lockstepNames(classes))
+	}
+}
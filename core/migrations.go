@@ -0,0 +1,406 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// A schema change of the index database. Migrations are applied in order of their version
+// and each one runs inside its own transaction.
+type migration struct {
+	version     int
+	description string
+	destructive bool // The database file gets backed up before this migration runs
+	up          func(tx *sql.Tx) error
+}
+
+// All schema migrations. Never change or reorder released migrations, only append new ones.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create files and duplicates tables",
+		up: func(tx *sql.Tx) error {
+			statements := []string{
+				`CREATE TABLE IF NOT EXISTS files (
+					guid TEXT PRIMARY KEY,
+					path TEXT NOT NULL,
+					extension TEXT NOT NULL,
+					size INTEGER NOT NULL,
+					mod_time INTEGER NOT NULL,
+					hash TEXT,
+					humanized_size TEXT
+				)`,
+				`CREATE TABLE IF NOT EXISTS duplicates (
+					guid TEXT PRIMARY KEY,
+					scanned INTEGER NOT NULL,
+					FOREIGN KEY (guid) REFERENCES files(guid)
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_files_path ON files (path)`, // Index path for faster lookups if needed
+				`CREATE INDEX IF NOT EXISTS idx_files_size ON files (size)`, // Index size for faster grouping
+				`CREATE INDEX IF NOT EXISTS idx_files_hash ON files (hash)`, // Index hash for faster grouping
+			}
+			return execAll(tx, statements)
+		},
+	},
+	{
+		version:     2,
+		description: "add partial hash column to files",
+		up: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "files", "partial_hash", "TEXT")
+		},
+	},
+	{
+		version:     3,
+		description: "add hash algorithm column to files",
+		up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "files", "hash_algorithm", "TEXT"); err != nil {
+				return err
+			}
+			// older versions used MD5 below 2GB and SHA-256 above, tell them apart by length
+			_, err := tx.Exec(`
+				UPDATE files SET hash_algorithm = CASE length(hash) WHEN 32 THEN 'md5' WHEN 64 THEN 'sha256' END
+				WHERE hash IS NOT NULL AND hash_algorithm IS NULL
+			`)
+			return err
+		},
+	},
+	{
+		version:     4,
+		description: "add link target column to files",
+		up: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "files", "link_target", "TEXT")
+		},
+	},
+	{
+		version:     5,
+		description: "create protected roots table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS protected_roots (
+					path TEXT PRIMARY KEY,
+					added INTEGER NOT NULL
+				)
+			`)
+			return err
+		},
+	},
+	{
+		version:     6,
+		description: "create journal table",
+		up: func(tx *sql.Tx) error {
+			return execAll(tx, []string{
+				`CREATE TABLE IF NOT EXISTS journal (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					operation_id TEXT NOT NULL,
+					action TEXT NOT NULL,
+					original_path TEXT NOT NULL,
+					new_path TEXT NOT NULL,
+					hash TEXT,
+					hash_algorithm TEXT,
+					timestamp INTEGER NOT NULL,
+					undone INTEGER NOT NULL DEFAULT 0
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_journal_operation ON journal (operation_id)`,
+			})
+		},
+	},
+	{
+		version:     7,
+		description: "replace duplicates table with verified groups",
+		destructive: true,
+		up: func(tx *sql.Tx) error {
+			return execAll(tx, []string{
+				`CREATE TABLE IF NOT EXISTS groups (
+					group_id INTEGER PRIMARY KEY AUTOINCREMENT,
+					hash TEXT NOT NULL,
+					hash_algorithm TEXT,
+					size INTEGER NOT NULL,
+					verified_at INTEGER NOT NULL,
+					method TEXT NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS group_members (
+					group_id INTEGER NOT NULL,
+					guid TEXT NOT NULL,
+					PRIMARY KEY (group_id, guid),
+					FOREIGN KEY (group_id) REFERENCES groups(group_id)
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_group_members_guid ON group_members (guid)`,
+				// the old duplicates can only be grouped by hash, they are marked as legacy groups
+				`INSERT INTO groups (hash, hash_algorithm, size, verified_at, method)
+					SELECT f.hash, MAX(f.hash_algorithm), f.size, MAX(d.scanned), 'legacy'
+					FROM duplicates d
+					INNER JOIN files f ON f.guid = d.guid
+					WHERE f.hash IS NOT NULL
+					GROUP BY f.size, f.hash
+					HAVING COUNT(*) > 1`,
+				`INSERT INTO group_members (group_id, guid)
+					SELECT g.group_id, f.guid
+					FROM duplicates d
+					INNER JOIN files f ON f.guid = d.guid
+					INNER JOIN groups g ON g.hash = f.hash AND g.size = f.size`,
+				`DROP TABLE duplicates`,
+			})
+		},
+	},
+	{
+		version:     8,
+		description: "create scan sessions and link groups to them",
+		up: func(tx *sql.Tx) error {
+			err := execAll(tx, []string{
+				`CREATE TABLE IF NOT EXISTS scan_sessions (
+					session_id INTEGER PRIMARY KEY AUTOINCREMENT,
+					started_at INTEGER NOT NULL,
+					finished_at INTEGER,
+					file_count INTEGER NOT NULL DEFAULT 0,
+					group_count INTEGER NOT NULL DEFAULT 0,
+					duplicate_count INTEGER NOT NULL DEFAULT 0,
+					wasted_bytes INTEGER NOT NULL DEFAULT 0,
+					settings TEXT
+				)`,
+			})
+			if err != nil {
+				return err
+			}
+			if err := addColumnIfMissing(tx, "groups", "session_id", "INTEGER REFERENCES scan_sessions(session_id)"); err != nil {
+				return err
+			}
+			// members removed by an action stay in the group, so the groups of a session show what its scan found
+			if err := addColumnIfMissing(tx, "group_members", "removed_at", "INTEGER"); err != nil {
+				return err
+			}
+			_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_groups_session ON groups (session_id)`)
+			return err
+		},
+	},
+	{
+		version:     9,
+		description: "create roots table",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				CREATE TABLE IF NOT EXISTS roots (
+					path TEXT PRIMARY KEY,
+					label TEXT UNIQUE,
+					recursive INTEGER NOT NULL DEFAULT 1,
+					filter TEXT,
+					min_size INTEGER NOT NULL DEFAULT 0,
+					added INTEGER NOT NULL,
+					scanned INTEGER
+				)
+			`)
+			return err
+		},
+	},
+}
+
+// Common methods of sql.DB and sql.Tx
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func execAll(db dbExecutor, statements []string) error {
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a column to an existing table, if the table does not have it yet
+func addColumnIfMissing(db dbExecutor, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var name string
+	err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&name)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Returns the schema version of the database. Databases without a schema_version table have version 0.
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	var tableName string
+	err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&tableName)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Returns the migrations newer than the given schema version
+func pendingMigrations(version int) []migration {
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// Applies all pending migrations and returns how many were applied
+func applyMigrations(db *sql.DB, dbFileName string, verbose bool) (int, error) {
+	version, err := currentSchemaVersion(db)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	pending := pendingMigrations(version)
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	// back up the database once before the first destructive migration, a new database has nothing to lose
+	hasFiles, err := tableExists(db, "files")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema: %v", err)
+	}
+	for _, m := range pending {
+		if m.destructive && hasFiles {
+			backupFile, err := backupDatabase(db, dbFileName, version)
+			if err != nil {
+				return 0, fmt.Errorf("failed to back up database before migration %d: %v", m.version, err)
+			}
+			fmt.Printf("Backed up database to %s\n", backupFile)
+			break
+		}
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+
+	applied := 0
+	for _, m := range pending {
+		if err := applyMigration(db, m); err != nil {
+			return applied, err
+		}
+		applied++
+		if verbose {
+			fmt.Printf("Applied database migration %d: %s\n", m.version, m.description)
+		}
+	}
+
+	return applied, nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for migration %d: %v", m.version, err)
+	}
+	defer tx.Rollback() // Rollback if not committed
+
+	if err := m.up(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_version (version, description, applied) VALUES (?, ?, ?)",
+		m.version, m.description, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d: %v", m.version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %v", m.version, err)
+	}
+	return nil
+}
+
+// Writes a consistent copy of the database next to the database file
+func backupDatabase(db *sql.DB, dbFileName string, version int) (string, error) {
+	backupFile := fmt.Sprintf("%s.v%d-%s.bak", dbFileName, version, time.Now().Format("20060102_150405"))
+	if _, err := db.Exec("VACUUM INTO ?", backupFile); err != nil {
+		return "", err
+	}
+	return backupFile, nil
+}
+
+// Lists the pending migrations of the configured database and applies them, unless DryRun is set
+func MigrateDatabase(config *Config) {
+	db, err := openDatabase(config.DBFilename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	version, err := currentSchemaVersion(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Failed to read schema version: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Database: %s\n", config.DBFilename)
+	fmt.Printf("Schema version: %d (latest: %d)\n", version, migrations[len(migrations)-1].version)
+
+	pending := pendingMigrations(version)
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations")
+		return
+	}
+
+	for _, m := range pending {
+		if m.destructive {
+			fmt.Printf("- %d: %s (destructive, database gets backed up first)\n", m.version, m.description)
+		} else {
+			fmt.Printf("- %d: %s\n", m.version, m.description)
+		}
+	}
+
+	if config.DryRun {
+		fmt.Printf("Would apply %d migrations\n", len(pending))
+		return
+	}
+
+	applied, err := applyMigrations(db, config.DBFilename, config.Debug)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Applied %d migrations\n", applied)
+}
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Returns the destination of file in the directory. Name clashes get a unique suffix.
+func flatDestination(dir string, file *FileItem) string {
+	// Get the base filename from the original path
+	baseFileName := filepath.Base(file.Path)
+	// Create the destination path by joining the target directory with the filename
+	destPath := filepath.Join(dir, baseFileName)
+
+	// Check if destination file already exists
+	if _, err := os.Stat(destPath); err == nil {
+		// File exists, create a unique name
+		ext := filepath.Ext(baseFileName)
+		name := baseFileName[:len(baseFileName)-len(ext)]
+		destPath = filepath.Join(dir, fmt.Sprintf("%s_%d%s", name, time.Now().UnixNano(), ext))
+	}
+	return destPath
+}
+
+// Returns the destination of file below the directory, its path recreated inside of it.
+// An existing file at the destination is an error, it was most likely moved there by an earlier run.
+func mirrorDestination(dir string, file *FileItem, root *Root) (string, error) {
+	relPath, err := mirrorPath(file, root)
+	if err != nil {
+		return "", err
+	}
+	destPath := filepath.Join(dir, relPath)
+	if _, err := os.Lstat(destPath); err == nil {
+		return "", fmt.Errorf("%s exists already", destPath)
+	}
+	return destPath, nil
+}
+
+// Returns the path of file as a relative path. Files in a root get the root name and their path inside of the root,
+// other files their absolute path. The drive of Windows paths becomes the first directory.
+func mirrorPath(file *FileItem, root *Root) (string, error) {
+	absPath, err := filepath.Abs(file.Path)
+	if err != nil {
+		return "", err
+	}
+	if root != nil {
+		relPath, err := filepath.Rel(root.Path, absPath)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(root.Name(), relPath), nil
+	}
+	volume := filepath.VolumeName(absPath)
+	relPath := strings.TrimLeft(absPath[len(volume):], `/\`)
+	return filepath.Join(strings.Trim(volume, `:/\`), relPath), nil
+}
+
+// CSV file listing every file moved by a mirrored move
+type moveManifest struct {
+	path   string
+	file   *os.File
+	writer *csv.Writer
+	count  int
+}
+
+// Creates a new manifest in the directory
+func newMoveManifest(dir string) (*moveManifest, error) {
+	timestamp := time.Now().Format("20060102_150405")
+	path := filepath.Join(dir, fmt.Sprintf("dupefiles_manifest_%s.csv", timestamp))
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create manifest: %v", err)
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Comma = ';'
+	manifest := &moveManifest{path: path, file: file, writer: writer}
+
+	header := []string{"Moved Path", "Original Path", "Kept Path"}
+	if err := manifest.write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Adds a moved file. Every line is flushed right away, so the manifest is complete even if the move gets interrupted.
+func (m *moveManifest) add(movedPath, originalPath, keptPath string) error {
+	if absPath, err := filepath.Abs(originalPath); err == nil {
+		originalPath = absPath
+	}
+	if absPath, err := filepath.Abs(keptPath); err == nil {
+		keptPath = absPath
+	}
+	if err := m.write([]string{movedPath, originalPath, keptPath}); err != nil {
+		return err
+	}
+	m.count++
+	return nil
+}
+
+func (m *moveManifest) write(record []string) error {
+	if err := m.writer.Write(record); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	m.writer.Flush()
+	if err := m.writer.Error(); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// Closes the manifest. An empty manifest gets removed.
+func (m *moveManifest) close() {
+	m.file.Close()
+	if m.count == 0 {
+		os.Remove(m.path)
+	}
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files of at least this size show the progress while being copied
+const copyProgressThreshold = 64 * 1024 * 1024 // 64MB
+
+// Moves the file from src to dst. If both are on different filesystems, the file gets copied instead,
+// the copy is checked against hash and the source is removed afterwards.
+// Without a hash the source gets hashed before copying.
+func moveFile(src, dst string, hash, hashAlgorithm sql.NullString) error {
+	err := os.Rename(src, dst)
+	if err == nil || !isCrossDeviceError(err) {
+		return err
+	}
+	return copyAndRemoveFile(src, dst, hash, hashAlgorithm)
+}
+
+// Copies src to dst, verifies the copy and removes src. dst is removed again if anything fails.
+func copyAndRemoveFile(src, dst string, hash, hashAlgorithm sql.NullString) error {
+	algorithm := hashAlgorithm.String
+	if !hashAlgorithm.Valid || algorithm == "" {
+		algorithm = DefaultHashAlgorithm
+	}
+	hasher, err := GetHasher(algorithm)
+	if err != nil {
+		return err
+	}
+
+	expected := hash.String
+	if !hash.Valid || expected == "" {
+		if expected, err = CalculateFileHash(src, hasher); err != nil {
+			return err
+		}
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+
+	actual, err := CalculateFileHash(dst, hasher)
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if actual != expected {
+		os.Remove(dst)
+		return fmt.Errorf("copy of %s does not match its hash, the file may have changed since the scan", src)
+	}
+
+	if err := os.Remove(src); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to remove %s after copying: %v", src, err)
+	}
+	return nil
+}
+
+// Copies the content, permissions and modification time of src to dst and flushes it to disk.
+// A partial copy is removed if anything fails.
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(dst)
+		}
+	}()
+
+	var writer io.Writer = out
+	if info.Size() >= copyProgressThreshold {
+		progress := &progressWriter{name: filepath.Base(src), total: info.Size()}
+		writer = io.MultiWriter(out, progress)
+		defer progress.done()
+	}
+
+	if _, err = io.Copy(writer, in); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	// the umask may have dropped permission bits when creating the file
+	if err = os.Chmod(dst, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// Shows how much of a file was copied, in steps of one percent
+type progressWriter struct {
+	name    string
+	total   int64
+	written int64
+	percent int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if percent := p.written * 100 / p.total; percent != p.percent {
+		p.percent = percent
+		fmt.Printf("\r  Copying %s: %d%% (%s of %s)", p.name, percent, HumanizeBytes(p.written), HumanizeBytes(p.total))
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) done() {
+	fmt.Println()
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Bytes per FIDEDUPERANGE request, some filesystems limit a single request to 16MB
+const dedupeChunkSize = 16 * 1024 * 1024
+
+var errReflinkUnsupported = errors.New("the filesystem does not support reflink deduplication (FIDEDUPERANGE), use btrfs or XFS")
+
+// Lets the files share their extents with keepPath. The kernel compares the bytes
+// of every range before sharing it, so files with other content are left alone.
+// Returns the number of deduplicated bytes for each file, files with other content stop early.
+func dedupeFiles(keepPath string, paths []string, size int64) ([]int64, error) {
+	src, err := os.Open(keepPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	deduped := make([]int64, len(paths))
+	dests := make([]*os.File, len(paths))
+	for i, path := range paths {
+		// the kernel needs write access to the destination, unless the caller owns it
+		dest, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			dest, err = os.Open(path)
+		}
+		if err != nil {
+			return deduped, err
+		}
+		defer dest.Close()
+		dests[i] = dest
+	}
+
+	differs := make([]bool, len(paths))
+	for offset := int64(0); offset < size; offset += dedupeChunkSize {
+		length := min(dedupeChunkSize, size-offset)
+
+		// only files that matched so far take part in the next request
+		var infoIndex []int
+		dedupeRange := &unix.FileDedupeRange{
+			Src_offset: uint64(offset),
+			Src_length: uint64(length),
+		}
+		for i, dest := range dests {
+			if differs[i] {
+				continue
+			}
+			infoIndex = append(infoIndex, i)
+			dedupeRange.Info = append(dedupeRange.Info, unix.FileDedupeRangeInfo{
+				Dest_fd:     int64(dest.Fd()),
+				Dest_offset: uint64(offset),
+			})
+		}
+		if len(infoIndex) == 0 {
+			break
+		}
+
+		if err := unix.IoctlFileDedupeRange(int(src.Fd()), dedupeRange); err != nil {
+			if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EXDEV) {
+				return deduped, errReflinkUnsupported
+			}
+			return deduped, err
+		}
+
+		for j, info := range dedupeRange.Info {
+			i := infoIndex[j]
+			switch {
+			case info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+				differs[i] = true
+			case info.Status < 0:
+				return deduped, fmt.Errorf("%s: %v", paths[i], unix.Errno(-info.Status))
+			default:
+				deduped[i] += int64(info.Bytes_deduped)
+			}
+		}
+	}
+
+	return deduped, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package core
+
+import (
+	"errors"
+)
+
+var errReflinkUnsupported = errors.New("reflink deduplication is only supported on Linux")
+
+// Lets the files share their extents with keepPath. Not available on this platform.
+func dedupeFiles(keepPath string, paths []string, size int64) ([]int64, error) {
+	return make([]int64, len(paths)), errReflinkUnsupported
+}
@@ -0,0 +1,306 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What happens to a file after the review
+type reviewChoice int
+
+const (
+	reviewSkip reviewChoice = iota
+	reviewKeep
+	reviewDelete
+	reviewHardlink
+)
+
+func (c reviewChoice) String() string {
+	switch c {
+	case reviewKeep:
+		return "keep"
+	case reviewDelete:
+		return "delete"
+	case reviewHardlink:
+		return "hardlink"
+	default:
+		return "skip"
+	}
+}
+
+// A duplicate group and the choices made for its files
+type reviewGroup struct {
+	files   []*FileItem
+	choices []reviewChoice
+	locked  []bool   // Protected and never touch files can only be kept
+	roots   []string // Name of the root of each file, empty if it is in no root
+}
+
+const reviewHelp = `Commands:
+  k N...   keep the files with the given numbers
+  d N...   delete the files (moved to the trash)
+  h N...   replace the files with hard links to the first kept file
+  s N...   skip the files, they are left as they are
+  n        next group (also enter)
+  p        previous group
+  g N      go to group N
+  f        finish the review, show the changes and ask for confirmation
+  q        quit without any changes
+  ?        show this help`
+
+// Steps through all duplicate groups and lets the user decide for every file.
+// Nothing is changed until the review is finished and confirmed, the changes are made by the same
+// actions as --trash and --hardlink.
+func (a *App) ReviewDuplicateFiles() {
+	var groups []*reviewGroup
+	for _, files := range a.index.GetDuplicateFileGroups() {
+		groups = append(groups, a.newReviewGroup(files))
+	}
+	if len(groups) == 0 {
+		fmt.Println("No duplicate files in database. Run --scan first.")
+		return
+	}
+
+	input := bufio.NewReader(os.Stdin)
+	fmt.Println(reviewHelp)
+
+	current := 0
+	for {
+		groups[current].print(current+1, len(groups))
+
+		fmt.Print("> ")
+		line, err := input.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Println("\nReview aborted, nothing changed")
+			return
+		}
+
+		fields := strings.Fields(line)
+		command := ""
+		if len(fields) > 0 {
+			command = strings.ToLower(fields[0])
+		}
+
+		switch command {
+		case "", "n":
+			if current < len(groups)-1 {
+				current++
+			} else {
+				fmt.Println("This is the last group, finish with f")
+			}
+		case "p":
+			if current > 0 {
+				current--
+			} else {
+				fmt.Println("This is the first group")
+			}
+		case "g":
+			number, err := parseReviewNumber(fields, len(groups))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			current = number - 1
+		case "k", "d", "h", "s":
+			choice := map[string]reviewChoice{"k": reviewKeep, "d": reviewDelete, "h": reviewHardlink, "s": reviewSkip}[command]
+			if err := groups[current].choose(fields[1:], choice); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		case "f":
+			if a.applyReview(groups, input) {
+				return
+			}
+		case "q":
+			fmt.Println("Review aborted, nothing changed")
+			return
+		case "?", "help":
+			fmt.Println(reviewHelp)
+		default:
+			fmt.Printf("Unknown command %q, ? shows the help\n", command)
+		}
+	}
+}
+
+// Creates a review group. The copies the keep policy would keep start as kept, all others as skipped.
+func (a *App) newReviewGroup(files []*FileItem) *reviewGroup {
+	group := &reviewGroup{
+		files:   files,
+		choices: make([]reviewChoice, len(files)),
+		locked:  make([]bool, len(files)),
+		roots:   make([]string, len(files)),
+	}
+
+	keep, _ := a.keepPolicy.Select(files)
+	for i, file := range files {
+		if root := a.rootFor(file.Path); root != nil {
+			group.roots[i] = "[" + root.Name() + "] "
+		}
+		if file == keep {
+			group.choices[i] = reviewKeep
+		}
+		if a.keepPolicy.Protected(file) || a.keepPolicy.NeverTouch(file) {
+			group.choices[i] = reviewKeep
+			group.locked[i] = true
+		}
+	}
+	return group
+}
+
+func (g *reviewGroup) print(number, total int) {
+	fmt.Printf("\nGroup %d of %d: %d files of %s\n", number, total, len(g.files), HumanizeBytes(g.files[0].Size))
+	for i, file := range g.files {
+		choice := g.choices[i].String()
+		if g.locked[i] {
+			choice += "*"
+		}
+		fmt.Printf("  %d) %-9s %s  %10s  %s%s\n", i+1, choice,
+			time.Unix(file.ModTime, 0).Format("2006-01-02 15:04:05"), file.HumanizedSize, g.roots[i], file.Path)
+	}
+	if g.hasLocked() {
+		fmt.Println("  * protected or never touch, always kept")
+	}
+}
+
+func (g *reviewGroup) hasLocked() bool {
+	for _, locked := range g.locked {
+		if locked {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the choice for the files with the given numbers
+func (g *reviewGroup) choose(args []string, choice reviewChoice) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no file numbers given")
+	}
+
+	var indexes []int
+	for _, arg := range args {
+		number, err := strconv.Atoi(arg)
+		if err != nil || number < 1 || number > len(g.files) {
+			return fmt.Errorf("invalid file number %q, expected 1 to %d", arg, len(g.files))
+		}
+		if g.locked[number-1] && choice != reviewKeep {
+			return fmt.Errorf("%s is protected or matches a never touch pattern", g.files[number-1].Path)
+		}
+		indexes = append(indexes, number-1)
+	}
+
+	for _, i := range indexes {
+		g.choices[i] = choice
+	}
+	return nil
+}
+
+// Returns the decisions for deleting and hardlinking. The first kept file is the target of the hard links.
+// A group without a kept file returns no decisions.
+func (g *reviewGroup) decisions() (deleteDecision, hardlinkDecision keepDecision, ok bool) {
+	var keep *FileItem
+	for i, file := range g.files {
+		if g.choices[i] == reviewKeep {
+			keep = file
+			break
+		}
+	}
+
+	deleteDecision.keep = keep
+	hardlinkDecision.keep = keep
+	for i, file := range g.files {
+		switch g.choices[i] {
+		case reviewDelete:
+			deleteDecision.rest = append(deleteDecision.rest, file)
+		case reviewHardlink:
+			hardlinkDecision.rest = append(hardlinkDecision.rest, file)
+		}
+	}
+	return deleteDecision, hardlinkDecision, keep != nil
+}
+
+// Shows the changes of the review and makes them after confirmation.
+// Returns false if the user wants to go on with the review.
+func (a *App) applyReview(groups []*reviewGroup, input *bufio.Reader) bool {
+	var deleteDecisions, hardlinkDecisions []keepDecision
+	deleteSize, hardlinkSize := int64(0), int64(0)
+
+	fmt.Println("\nChanges:")
+	for i, group := range groups {
+		deleteDecision, hardlinkDecision, ok := group.decisions()
+		if len(deleteDecision.rest) == 0 && len(hardlinkDecision.rest) == 0 {
+			continue
+		}
+		if !ok {
+			fmt.Printf("  Group %d: no copy is kept, the group is left as it is\n", i+1)
+			continue
+		}
+
+		for _, file := range deleteDecision.rest {
+			fmt.Printf("  delete   %s\n", file.Path)
+			deleteSize += file.Size
+		}
+		for _, file := range hardlinkDecision.rest {
+			fmt.Printf("  hardlink %s -> %s\n", file.Path, hardlinkDecision.keep.Path)
+			hardlinkSize += file.Size
+		}
+
+		if len(deleteDecision.rest) > 0 {
+			deleteDecisions = append(deleteDecisions, deleteDecision)
+		}
+		if len(hardlinkDecision.rest) > 0 {
+			hardlinkDecisions = append(hardlinkDecisions, hardlinkDecision)
+		}
+	}
+
+	if len(deleteDecisions) == 0 && len(hardlinkDecisions) == 0 {
+		fmt.Println("  none")
+		return a.confirmReview(input, "Quit the review? [y/N] ")
+	}
+
+	fmt.Printf("Delete %d files (%s), hardlink %d files (%s)\n",
+		countDecisionFiles(deleteDecisions), HumanizeBytes(deleteSize), countDecisionFiles(hardlinkDecisions), HumanizeBytes(hardlinkSize))
+	if !a.confirmReview(input, "Apply these changes? [y/N] ") {
+		fmt.Println("Nothing changed, back to the review")
+		return false
+	}
+
+	if len(deleteDecisions) > 0 {
+		a.trashDuplicates(deleteDecisions)
+	}
+	if len(hardlinkDecisions) > 0 {
+		a.hardlinkDuplicates(hardlinkDecisions)
+	}
+	return true
+}
+
+// Asks a yes or no question, anything but yes is no
+func (a *App) confirmReview(input *bufio.Reader, question string) bool {
+	fmt.Print(question)
+	line, _ := input.ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+func countDecisionFiles(decisions []keepDecision) int {
+	count := 0
+	for _, decision := range decisions {
+		count += len(decision.rest)
+	}
+	return count
+}
+
+// Parses the group number argument of the go to command
+func parseReviewNumber(fields []string, total int) (int, error) {
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("no group number given")
+	}
+	number, err := strconv.Atoi(fields[1])
+	if err != nil || number < 1 || number > total {
+		return 0, fmt.Errorf("invalid group number %q, expected 1 to %d", fields[1], total)
+	}
+	return number, nil
+}
@@ -0,0 +1,320 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A directory added to the index, with the settings it is walked with
+type Root struct {
+	Path      string // Absolute path of the directory
+	Label     string // Optional name of the root, e.g. "photos"
+	Recursive bool
+	Filter    *Filter // Decides which files of the root are indexed
+	Added     int64
+	Scanned   int64 // Unix timestamp of the last walk, 0 if never walked
+}
+
+// Returns the label of the root, or the name of its directory
+func (r *Root) Name() string {
+	if r.Label != "" {
+		return r.Label
+	}
+	return filepath.Base(r.Path)
+}
+
+// Returns all roots stored in the index, ordered by path
+func (idx *Index) GetRoots() ([]*Root, error) {
+	rows, err := idx.db.Query("SELECT path, label, recursive, filter, min_size, added, scanned FROM roots ORDER BY path")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query roots: %v", err)
+	}
+	defer rows.Close()
+
+	var roots []*Root
+	for rows.Next() {
+		var root Root
+		var label, filter sql.NullString
+		var minSize int64
+		var scanned sql.NullInt64
+		if err := rows.Scan(&root.Path, &label, &root.Recursive, &filter, &minSize, &root.Added, &scanned); err != nil {
+			return nil, fmt.Errorf("failed to scan root: %v", err)
+		}
+		root.Label = label.String
+		root.Scanned = scanned.Int64
+		if root.Filter, err = parseStoredFilter(filter.String, minSize); err != nil {
+			return nil, fmt.Errorf("root %s: %v", root.Path, err)
+		}
+		roots = append(roots, &root)
+	}
+	return roots, rows.Err()
+}
+
+// Adds a root or updates the settings of an existing one. An empty label keeps the label of an existing root.
+func (idx *Index) SaveRoot(root *Root) error {
+	filter, err := root.Filter.stored()
+	if err != nil {
+		return err
+	}
+	_, err = idx.db.Exec(`
+		INSERT INTO roots (path, label, recursive, filter, min_size, added)
+		VALUES (?, NULLIF(?, ''), ?, ?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET
+			label = COALESCE(excluded.label, roots.label),
+			recursive = excluded.recursive,
+			filter = excluded.filter,
+			min_size = excluded.min_size
+	`, root.Path, root.Label, root.Recursive, filter, root.Filter.MinSize, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to save root %s: %v", root.Path, err)
+	}
+	return nil
+}
+
+// Stores when the root was walked the last time
+func (idx *Index) MarkRootScanned(path string) error {
+	_, err := idx.db.Exec("UPDATE roots SET scanned = ? WHERE path = ?", time.Now().Unix(), path)
+	if err != nil {
+		return fmt.Errorf("failed to update root %s: %v", path, err)
+	}
+	return nil
+}
+
+// Removes the root from the index. Returns false if there was no such root.
+func (idx *Index) RemoveRoot(path string) (bool, error) {
+	result, err := idx.db.Exec("DELETE FROM roots WHERE path = ?", path)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove root %s: %v", path, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// Returns the roots of the index. They are read once per run.
+func (a *App) getRoots() []*Root {
+	if a.roots == nil {
+		roots, err := a.index.GetRoots()
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+		a.roots = roots
+	}
+	return a.roots
+}
+
+// Returns the innermost root containing the path, or nil if the path is in no root
+func (a *App) rootFor(path string) *Root {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	var found *Root
+	for _, root := range a.getRoots() {
+		if isPathUnder(absPath, root.Path) && (found == nil || len(root.Path) > len(found.Path)) {
+			found = root
+		}
+	}
+	return found
+}
+
+// Returns the root with the given path or label
+func (a *App) findRoot(pathOrLabel string) *Root {
+	absPath, _ := filepath.Abs(pathOrLabel)
+	for _, root := range a.getRoots() {
+		if root.Path == absPath || (root.Label != "" && root.Label == pathOrLabel) {
+			return root
+		}
+	}
+	return nil
+}
+
+// Records a directory as root and adds its files to the index
+func (a *App) AddRoot(path, label string, recursive bool, filter *Filter) {
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "Error: No path specified\n")
+		os.Exit(1)
+	}
+
+	root, err := a.saveRoot(path, label, recursive, filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	added, removed, err := a.indexRoot(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Added root %s (%s): %d files added or updated, %d removed\n", root.Path, root.Name(), added, removed)
+}
+
+// Stores the root with its settings
+func (a *App) saveRoot(path, label string, recursive bool, filter *Filter) (*Root, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", absPath)
+	}
+
+	root := &Root{
+		Path:      absPath,
+		Label:     label,
+		Recursive: recursive,
+		Filter:    filter,
+	}
+	if err := a.index.SaveRoot(root); err != nil {
+		return nil, err
+	}
+
+	// the stored root keeps the label of an earlier add
+	a.roots = nil
+	if stored := a.findRoot(absPath); stored != nil {
+		return stored, nil
+	}
+	return root, nil
+}
+
+// Walks the root, adds new and changed files and drops files of the root that vanished or that the filter excludes now.
+// Returns the number of added and removed files.
+func (a *App) indexRoot(root *Root) (int, int, error) {
+	walked := make(map[string]bool)
+	added, err := a.indexWalk(root.Path, root.Recursive, root.Filter, walked)
+	if err != nil {
+		return added, 0, err
+	}
+
+	// files of the root the walk did not find, files of a nested root are left to that root
+	var vanished []string
+	err = a.index.ForEachFileUnder(root.Path, func(file *FileItem) error {
+		if walked[file.Guid] {
+			return nil
+		}
+		// the walk skips symbolic links, a file replaced by a link stays while the link is there
+		if file.LinkTarget.Valid {
+			if info, err := os.Lstat(file.Path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return nil
+			}
+		}
+		if fileRoot := a.rootFor(file.Path); fileRoot == nil || fileRoot.Path != root.Path {
+			return nil
+		}
+		vanished = append(vanished, file.Guid)
+		return nil
+	})
+	if err != nil {
+		return added, 0, err
+	}
+	removed, err := a.index.RemoveFiles(vanished)
+	if err != nil {
+		return added, removed, err
+	}
+
+	if err := a.index.MarkRootScanned(root.Path); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+	return added, removed, nil
+}
+
+// Walks all roots again. Roots that are not available, e.g. an unmounted drive, are skipped,
+// their files stay in the index.
+func (a *App) RescanRoots() {
+	roots := a.getRoots()
+	if len(roots) == 0 {
+		fmt.Println("No roots in database. Add one with --add or --root-add.")
+		return
+	}
+
+	totalAdded, totalRemoved := 0, 0
+	for _, root := range roots {
+		if _, err := os.Stat(root.Path); err != nil {
+			fmt.Printf("Warning: Skipping root %s: %v\n", root.Path, err)
+			continue
+		}
+
+		added, removed, err := a.indexRoot(root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error rescanning %s: %v\n", root.Path, err)
+			continue
+		}
+		fmt.Printf("%s (%s): %d files added or updated, %d removed\n", root.Path, root.Name(), added, removed)
+		totalAdded += added
+		totalRemoved += removed
+	}
+
+	fmt.Printf("Rescanned %d roots: %d files added or updated, %d removed\n", len(roots), totalAdded, totalRemoved)
+}
+
+// Lists all roots with their settings
+func (a *App) ShowRoots() {
+	roots := a.getRoots()
+	if len(roots) == 0 {
+		fmt.Println("No roots in database")
+		return
+	}
+
+	for _, root := range roots {
+		settings := []string{root.Filter.String()}
+		if !root.Recursive {
+			settings = append(settings, "not recursive")
+		}
+		scanned := "never"
+		if root.Scanned > 0 {
+			scanned = time.Unix(root.Scanned, 0).Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-12s %s (%s, scanned %s)\n", root.Name(), root.Path, strings.Join(settings, ", "), scanned)
+	}
+	fmt.Printf("Roots: %d total.\n", len(roots))
+}
+
+// Removes a root, given by path or label, and all of its files that are in no other root
+func (a *App) RemoveRootFromIndex(pathOrLabel string) {
+	if pathOrLabel == "" {
+		fmt.Fprintf(os.Stderr, "Error: No path specified\n")
+		os.Exit(1)
+	}
+
+	root := a.findRoot(pathOrLabel)
+	if root == nil {
+		fmt.Fprintf(os.Stderr, "Error: %s is no root\n", pathOrLabel)
+		os.Exit(1)
+	}
+
+	if _, err := a.index.RemoveRoot(root.Path); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	a.roots = nil
+
+	var guids []string
+	err := a.index.ForEachFileUnder(root.Path, func(file *FileItem) error {
+		if a.rootFor(file.Path) == nil {
+			guids = append(guids, file.Guid)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	removed, err := a.index.RemoveFiles(guids)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Removed root %s and %d files from database\n", root.Path, removed)
+}
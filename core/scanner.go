@@ -1,211 +1,461 @@
 package core
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"os"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
-const sizeThreshold = 2 * 1024 * 1024 * 1024 // 2GB
-
 type ResultList struct {
-	HashSum   string
-	FileGuids []string
+	HashSum       string
+	HashAlgorithm string
+	Size          int64
+	Method        string // How the content of the files was compared, see VerifyModeNames
+	FileGuids     []string
 }
 
 type Scanner struct {
-	idx *Index
+	ctx       context.Context // Cancelling it interrupts the scan, the hashes calculated so far are kept
+	idx       *Index
+	sessionID int64            // Scan session the groups of the running scan belong to
+	resumed   bool             // The scan continues an interrupted scan session
+	devices   *deviceScheduler // Spreads the hashing over the devices the files are stored on
 }
 
-func NewScanner(idx *Index) *Scanner {
-	return &Scanner{idx: idx}
+func NewScanner(ctx context.Context, idx *Index) *Scanner {
+	return &Scanner{ctx: ctx, idx: idx, devices: newDeviceScheduler(idx.config)}
 }
 
-// ScanBySize groups files by size
-func (s *Scanner) ScanBySize() (map[int64][]*FileItem, error) {
-	sizeGroups := make(map[int64][]*FileItem)
-	fmt.Println("Scanning for size equivalent files...")
-	for _, file := range s.idx.files {
-		sizeGroups[file.Size] = append(sizeGroups[file.Size], file)
+// Hashes are written to the index after this many files or bytes, so an interrupted scan keeps them
+const (
+	checkpointFiles = 1000
+	checkpointBytes = 1 << 30 // 1GB
+)
+
+// Continues an interrupted scan session with the settings it was started with. The groups the session
+// found already are kept and their files are not scanned again.
+func (s *Scanner) ResumeSession(session *ScanSession) error {
+	if session.FinishedAt != 0 {
+		return fmt.Errorf("scan session %d is finished already", session.SessionID)
+	}
+	settings := session.Settings
+	if settings.HashAlgorithm != s.idx.hasher.Name() {
+		return fmt.Errorf("scan session %d used the hash algorithm %s, resume it with --hash %s",
+			session.SessionID, settings.HashAlgorithm, settings.HashAlgorithm)
+	}
+
+	config := s.idx.config
+	config.PartialHashSize = settings.PartialHashSize
+	config.PartialHashTail = settings.PartialHashTail
+	config.LockstepMaxFiles = settings.LockstepMaxFiles
+	if settings.VerifyMethod != "" {
+		config.VerifyMode = settings.VerifyMethod
+	}
+	if settings.SampleBlocks > 0 {
+		config.SampleBlockSize = settings.SampleBlockSize
+		config.SampleBlocks = settings.SampleBlocks
 	}
-	return sizeGroups, nil
+
+	s.sessionID = session.SessionID
+	s.resumed = true
+	return nil
 }
 
-func (s *Scanner) ScanForDuplicates() ([]ResultList, error) {
-	// Step 1: Group files by size
-	sizeGroups, err := s.ScanBySize()
+// Number of files of the size groups one pass of the partial hash and hash stages works on
+const scanBatchSize = 10000
+
+// ScanBySize streams the groups of files with the same size from the index, in batches of about
+// scanBatchSize files. Sizes of a single file are left out by the database, files in a group of the
+// scan session already are left out too.
+func (s *Scanner) ScanBySize(fn func(map[int64][]*FileItem) error) error {
+	fmt.Println("Scanning for size equivalent files...")
+	sizes, err := s.idx.GetDuplicateSizes()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if s.idx.config.Debug {
+		fmt.Printf("  Found %d size groups.\n", len(sizes))
 	}
 
-	// Step 2: Calculate hashes for files in each size group
-	finalHashGroups, err := s.ScanByHash(sizeGroups)
-	if err != nil {
+	for start := 0; start < len(sizes); {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+
+		// the files of a batch are counted after loading, sizes are added until the batch is full
+		end := start
+		sizeGroups := make(map[int64][]*FileItem)
+		count := 0
+		for end < len(sizes) && count < scanBatchSize {
+			next := min(end+maxQueryParams, len(sizes))
+			groups, err := s.idx.GetFilesBySizes(sizes[end:next], s.sessionID)
+			if err != nil {
+				return err
+			}
+			for size, files := range groups {
+				// hard links to the same file take no extra space, they are no duplicates
+				files = collapseHardlinks(files)
+				if len(files) < 2 {
+					continue
+				}
+				sizeGroups[size] = files
+				count += len(files)
+			}
+			end = next
+		}
+		if err := fn(sizeGroups); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// Returns the id of the scan session of the last ScanForDuplicates run
+func (s *Scanner) SessionID() int64 {
+	return s.sessionID
+}
+
+// Scans the index for duplicates in a new scan session, or in the resumed one, see ResumeSession.
+// When the context is cancelled, the hashes calculated so far are written and the error of the context
+// is returned with the groups found until then. The session stays unfinished.
+func (s *Scanner) ScanForDuplicates() ([]ResultList, error) {
+	settings := ScanSettings{
+		HashAlgorithm:    s.idx.hasher.Name(),
+		MinFileSize:      s.idx.config.MinFileSize,
+		PartialHashSize:  s.idx.config.PartialHashSize,
+		PartialHashTail:  s.idx.config.PartialHashTail,
+		VerifyMethod:     s.idx.config.VerifyMode,
+		SampleBlockSize:  s.idx.config.SampleBlockSize,
+		SampleBlocks:     s.idx.config.SampleBlocks,
+		LockstepMaxFiles: s.idx.config.LockstepMaxFiles,
+	}
+	if err := checkVerifyMode(settings.VerifyMethod); err != nil {
 		return nil, err
 	}
+	if !s.resumed {
+		fileCount, err := s.idx.CountFiles()
+		if err != nil {
+			return nil, err
+		}
+		sessionID, err := s.idx.StartScanSession(settings, fileCount)
+		if err != nil {
+			return nil, err
+		}
+		s.sessionID = sessionID
+	}
 
-	// Step 3: Find actual duplicates by comparing file contents
-	fmt.Println("Verifying potential duplicates...")
 	var results []ResultList
 	var resultsMu sync.Mutex
 
-	var wg sync.WaitGroup
-	resultsChan := make(chan ResultList, len(finalHashGroups))
-	semaphore := make(chan struct{}, runtime.NumCPU()) // Limit concurrent hash groups
+	// Step 1: Group files by size, the groups come from the database in batches
+	err := s.ScanBySize(func(sizeGroups map[int64][]*FileItem) error {
+		// Small groups are compared in lockstep right away, their files are read only once
+		sizeGroups, lockstepResults := s.ScanByLockstep(sizeGroups)
+		for _, result := range lockstepResults {
+			results = append(results, *result)
+		}
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
 
-	for hash, filesInHashGroup := range finalHashGroups {
-		if len(filesInHashGroup) < 2 {
-			continue
+		// Step 2: Rule out files whose head (and tail) differ
+		sizeGroups, err := s.ScanByPartialHash(sizeGroups)
+		if err != nil {
+			return err
 		}
 
-		wg.Add(1)
-		go func(h string, files []*FileItem) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+		// Step 3: Calculate hashes for files in each size group, the hashes are stored in the index
+		_, err = s.ScanByHash(sizeGroups)
+		return err
+	})
+	if err != nil {
+		return results, err
+	}
 
-			result := s.findDuplicatesInHashGroup(h, files)
-			if result != nil {
-				if err := s.addDuplicatesToIndex(result); err != nil {
-					fmt.Printf("Warning: %v\n", err)
-				}
-				resultsChan <- *result
-			}
-		}(hash, filesInHashGroup)
+	// Step 4: Find actual duplicates by comparing file contents, with the workers of the devices.
+	// Files in a group of this scan already, from the lockstep comparison, are left out.
+	fmt.Println("Verifying potential duplicates...")
+	keys, err := s.idx.GetDuplicateHashes(s.idx.hasher.Name(), s.sessionID)
+	if err != nil {
+		return nil, err
 	}
 
-	go func() {
+	for start := 0; start < len(keys) && s.ctx.Err() == nil; {
+		// the hash groups are loaded in batches of about scanBatchSize files
+		var groups [][]*FileItem
+		var hashes []string
+		count := 0
+		for start < len(keys) && count < scanBatchSize {
+			key := keys[start]
+			start++
+			filesInHashGroup, err := s.idx.GetFilesByHash(key.size, key.hash, s.idx.hasher.Name(), s.sessionID)
+			if err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				continue
+			}
+			if len(filesInHashGroup) < 2 {
+				continue
+			}
+			groups = append(groups, filesInHashGroup)
+			hashes = append(hashes, key.hash)
+			count += len(filesInHashGroup)
+		}
+
+		// several groups are verified at the same time, their comparisons wait for the workers of the devices
+		var wg sync.WaitGroup
+		semaphore := make(chan struct{}, runtime.NumCPU())
+		for i := range groups {
+			if s.ctx.Err() != nil {
+				break // groups being verified are finished
+			}
+			semaphore <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-semaphore }()
+
+				// a hash group may hold several classes of identical files, each one is a group
+				for _, result := range s.findDuplicatesInHashGroup(hashes[i], groups[i]) {
+					if err := s.addDuplicatesToIndex(result); err != nil {
+						fmt.Printf("Warning: %v\n", err)
+					}
+					resultsMu.Lock()
+					results = append(results, *result)
+					resultsMu.Unlock()
+				}
+			}()
+		}
 		wg.Wait()
-		close(resultsChan)
-	}()
+	}
+	if err := s.ctx.Err(); err != nil {
+		return results, err
+	}
 
-	for result := range resultsChan {
-		resultsMu.Lock()
-		results = append(results, result)
-		resultsMu.Unlock()
+	// the groups of this scan replace the groups of the last one
+	if err := s.idx.FinishScanSession(s.sessionID); err != nil {
+		return nil, err
 	}
 
 	return results, nil
 }
 
-func (s *Scanner) ScanByHash(sizeGroups map[int64][]*FileItem) (map[string][]*FileItem, error) {
-	hashGroups, hashesToUpdate, err := s.calculateHashGroups(sizeGroups)
-	if err != nil {
-		return nil, err
+// ScanByPartialHash hashes only the head (and tail) of the files in each size group
+// and drops the files whose partial hash matches no other file of the group
+func (s *Scanner) ScanByPartialHash(sizeGroups map[int64][]*FileItem) (map[int64][]*FileItem, error) {
+	headSize := s.idx.config.PartialHashSize
+	withTail := s.idx.config.PartialHashTail
+	if headSize <= 0 {
+		return sizeGroups, nil
 	}
 
-	if err := s.updateHashesInIndex(hashesToUpdate); err != nil {
-		fmt.Printf("Warning: %v\n", err)
+	fmt.Println("Scanning for partial hash equivalent files...")
+	spec := PartialHashSpec(s.idx.hasher, headSize, withTail) + ":"
+	coveredSize := headSize
+	if withTail {
+		coveredSize *= 2
 	}
 
-	return hashGroups, nil
-}
-
-func (s *Scanner) calculateHashGroups(sizeGroups map[int64][]*FileItem) (map[string][]*FileItem, []struct{ guid, hash string }, error) {
-	finalHashGroups := make(map[string][]*FileItem)
-	var allHashesToUpdate []struct{ guid, hash string }
+	// collect files without a usable partial hash
+	var filesToHash []*FileItem
+	for size, filesInGroup := range sizeGroups {
+		// the partial hash would cover the whole file, the full hash is just as cheap
+		if len(filesInGroup) < 2 || size <= coveredSize {
+			continue
+		}
+		for _, file := range filesInGroup {
+			if !file.PartialHash.Valid || !strings.HasPrefix(file.PartialHash.String, spec) {
+				filesToHash = append(filesToHash, file)
+			}
+		}
+	}
 
-	fmt.Println("Scanning for hash equivalent files...")
-	totalSizeGroups := len(sizeGroups)
-	processedSizeGroups := 0
+	// create partial hash sums, every device with its own workers
+	if len(filesToHash) > 0 && s.idx.config.Debug {
+		fmt.Printf("  Calculating %d partial hashes...\n", len(filesToHash))
+	}
+	err := s.hashFiles(filesToHash, "partial hash", func(file *FileItem) (string, error) {
+		return CalculatePartialFileHash(file.Path, file.Size, s.idx.hasher, headSize, withTail)
+	}, func(file *FileItem, hash string) {
+		file.PartialHash = sql.NullString{String: hash, Valid: true}
+	}, s.updatePartialHashesInIndex)
+	if err != nil {
+		return nil, err
+	}
 
+	// keep only files whose partial hash collides with another file of the same size
+	candidateGroups := make(map[int64][]*FileItem)
+	ruledOut := 0
+	savedFullHashes := 0
 	for size, filesInGroup := range sizeGroups {
-		processedSizeGroups++
 		if len(filesInGroup) < 2 {
 			continue
 		}
-
-		if s.idx.config.Debug {
-			fmt.Printf("- processing size group %d/%d (size: %s bytes, files: %d)\n",
-				processedSizeGroups, totalSizeGroups, HumanizeBytes(size), len(filesInGroup))
+		if size <= coveredSize {
+			candidateGroups[size] = filesInGroup
+			continue
 		}
 
-		// create list of files to create hash sums
-		filesToHash := []*FileItem{}
+		partialGroups := make(map[string][]*FileItem)
 		for _, file := range filesInGroup {
-			if !file.Hash.Valid {
-				filesToHash = append(filesToHash, file)
-			} else {
-				finalHashGroups[file.Hash.String] = append(finalHashGroups[file.Hash.String], file)
+			if !file.PartialHash.Valid || !strings.HasPrefix(file.PartialHash.String, spec) {
+				// partial hash failed, leave the decision to the full hash
+				candidateGroups[size] = append(candidateGroups[size], file)
+				continue
 			}
+			partialGroups[file.PartialHash.String] = append(partialGroups[file.PartialHash.String], file)
 		}
 
-		// create hash sums
-		if len(filesToHash) > 0 {
-			type hashCalcResult struct {
-				file    *FileItem
-				hashStr string
-				err     error
+		for _, filesInPartialGroup := range partialGroups {
+			if len(filesInPartialGroup) < 2 {
+				ruledOut++
+				if !filesInPartialGroup[0].Hash.Valid {
+					savedFullHashes++
+				}
+				continue
 			}
+			candidateGroups[size] = append(candidateGroups[size], filesInPartialGroup...)
+		}
+	}
 
-			numJobs := len(filesToHash)
-			jobsChan := make(chan *FileItem, numJobs)
-			resultsChan := make(chan hashCalcResult, numJobs)
-			var wg sync.WaitGroup
+	if s.idx.config.Debug {
+		fmt.Printf("  Partial hash stage ruled out %d files and saved %d full hashes.\n", ruledOut, savedFullHashes)
+	}
 
-			numWorkers := calculateOptimalWorkers(numJobs)
+	return candidateGroups, nil
+}
 
-			if s.idx.config.Debug {
-				fmt.Printf("  Calculating %d hashes with %d workers...\n", numJobs, numWorkers)
-			}
+func (s *Scanner) ScanByHash(sizeGroups map[int64][]*FileItem) (map[string][]*FileItem, error) {
+	return s.calculateHashGroups(sizeGroups)
+}
 
-			for w := 0; w < numWorkers; w++ {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					for jobFile := range jobsChan {
-						var calculatedHash string
-						var err error
-						if jobFile.Hash.Valid && jobFile.Hash.String != "" {
-							calculatedHash = jobFile.Hash.String
-						} else {
-							if s.idx.config.Debug {
-								fmt.Printf("  Calculating hash for file %s...\n", jobFile.Path)
-							}
-							calculatedHash, err = CalculateFileHash(jobFile.Path, jobFile.Size)
-						}
-						resultsChan <- hashCalcResult{file: jobFile, hashStr: calculatedHash, err: err}
-					}
-				}()
-			}
+// Hashes the files of the size groups that have no valid hash yet and groups all files by hash.
+// The hashes are written to the index after every checkpoint.
+func (s *Scanner) calculateHashGroups(sizeGroups map[int64][]*FileItem) (map[string][]*FileItem, error) {
+	finalHashGroups := make(map[string][]*FileItem)
+
+	fmt.Println("Scanning for hash equivalent files...")
 
-			for _, file := range filesToHash {
-				jobsChan <- file
+	// create list of files to create hash sums
+	// hashes made by another algorithm can not be compared and get replaced
+	filesToHash := []*FileItem{}
+	for _, filesInGroup := range sizeGroups {
+		if len(filesInGroup) < 2 {
+			continue
+		}
+		for _, file := range filesInGroup {
+			valid := file.Hash.Valid && file.HashAlgorithm.String == s.idx.hasher.Name()
+			// a resumed scan trusts only hashes of files that did not change since they were indexed
+			if valid && s.resumed && !fileUnchanged(file) {
+				valid = false
+			}
+			if !valid {
+				filesToHash = append(filesToHash, file)
+			} else {
+				finalHashGroups[file.Hash.String] = append(finalHashGroups[file.Hash.String], file)
 			}
-			close(jobsChan)
+		}
+	}
 
-			wg.Wait()
-			close(resultsChan)
+	// create hash sums, every device with its own workers
+	if len(filesToHash) > 0 && s.idx.config.Debug {
+		fmt.Printf("  Calculating %d hashes of %d size groups...\n", len(filesToHash), len(sizeGroups))
+	}
+	err := s.hashFiles(filesToHash, "hash", func(file *FileItem) (string, error) {
+		if s.idx.config.Debug {
+			fmt.Printf("  Calculating hash for file %s...\n", file.Path)
+		}
+		return CalculateFileHashContext(s.ctx, file.Path, s.idx.hasher)
+	}, func(file *FileItem, hash string) {
+		file.Hash = sql.NullString{String: hash, Valid: true}
+		file.HashAlgorithm = sql.NullString{String: s.idx.hasher.Name(), Valid: true}
+		finalHashGroups[hash] = append(finalHashGroups[hash], file)
+	}, s.updateHashesInIndex)
+
+	return finalHashGroups, err
+}
 
-			var hashesToUpdateInDB []struct{ guid, hash string }
-			for res := range resultsChan {
-				if res.err != nil {
-					fmt.Printf("  Warning: Failed to calculate hash for %s: %v\n", res.file.Path, res.err)
-					continue
+// Calculates a hash of every file with calculate, every device with its own workers. After every checkpoint
+// the hashes are passed to done, one at a time, and written with store. When the scan is interrupted, the hashes
+// finished so far are written and the error of the context is returned.
+func (s *Scanner) hashFiles(files []*FileItem, what string, calculate func(*FileItem) (string, error),
+	done func(*FileItem, string), store func([]struct{ guid, hash string }) error) error {
+	for _, checkpoint := range splitCheckpoints(files) {
+		hashes := make([]string, len(checkpoint))
+		errs := make([]error, len(checkpoint))
+		s.devices.run(len(checkpoint), func(i int) []string { return []string{checkpoint[i].Path} }, func(i int) {
+			if errs[i] = s.ctx.Err(); errs[i] == nil {
+				hashes[i], errs[i] = calculate(checkpoint[i])
+			}
+		})
+
+		var hashesToUpdate []struct{ guid, hash string }
+		for i, file := range checkpoint {
+			if errs[i] != nil {
+				// files cut off by the interruption are no failures
+				if s.ctx.Err() == nil || !errors.Is(errs[i], s.ctx.Err()) {
+					fmt.Printf("  Warning: Failed to calculate %s for %s: %v\n", what, file.Path, errs[i])
 				}
-				res.file.Hash = sql.NullString{String: res.hashStr, Valid: true}
-				finalHashGroups[res.hashStr] = append(finalHashGroups[res.hashStr], res.file)
-				hashesToUpdateInDB = append(hashesToUpdateInDB, struct{ guid, hash string }{res.file.Guid, res.hashStr})
+				continue
 			}
+			done(file, hashes[i])
+			hashesToUpdate = append(hashesToUpdate, struct{ guid, hash string }{file.Guid, hashes[i]})
+		}
+		if err := store(hashesToUpdate); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
 
-			allHashesToUpdate = append(allHashesToUpdate, hashesToUpdateInDB...)
+		if err := s.ctx.Err(); err != nil {
+			return err
 		}
 	}
-
-	return finalHashGroups, allHashesToUpdate, nil
+	return nil
 }
 
-func calculateOptimalWorkers(numJobs int) int {
-	numWorkers := runtime.NumCPU()
-	if numWorkers > numJobs {
-		numWorkers = numJobs
+// Splits the files into checkpoints of at most checkpointFiles files and about checkpointBytes bytes
+func splitCheckpoints(files []*FileItem) [][]*FileItem {
+	var checkpoints [][]*FileItem
+	start := 0
+	size := int64(0)
+	for i, file := range files {
+		size += file.Size
+		if i+1-start >= checkpointFiles || size >= checkpointBytes || i == len(files)-1 {
+			checkpoints = append(checkpoints, files[start:i+1])
+			start = i + 1
+			size = 0
+		}
 	}
-	if numWorkers == 0 {
-		numWorkers = 1
+	return checkpoints
+}
+
+// Returns the files without the ones that are hard links to a file before them. Files that can not
+// be identified are kept, they fail later on their own.
+func collapseHardlinks(files []*FileItem) []*FileItem {
+	seen := make(map[fileKey]bool, len(files))
+	collapsed := make([]*FileItem, 0, len(files))
+	for _, file := range files {
+		if key, ok := fileID(file.Path); ok {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		collapsed = append(collapsed, file)
 	}
-	return numWorkers
+	return collapsed
+}
+
+// Checks that the file still has the size and modification time of the index
+func fileUnchanged(file *FileItem) bool {
+	info, err := os.Stat(file.Path)
+	return err == nil && info.Size() == file.Size && info.ModTime().Unix() == file.ModTime
 }
 
 // Updates hash values in the database
@@ -220,7 +470,7 @@ func (s *Scanner) updateHashesInIndex(hashesToUpdate []struct{ guid, hash string
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("UPDATE files SET hash = ? WHERE guid = ?")
+	stmt, err := tx.Prepare("UPDATE files SET hash = ?, hash_algorithm = ? WHERE guid = ?")
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
@@ -228,7 +478,7 @@ func (s *Scanner) updateHashesInIndex(hashesToUpdate []struct{ guid, hash string
 
 	updatedCount := 0
 	for _, h := range hashesToUpdate {
-		_, err := stmt.Exec(h.hash, h.guid)
+		_, err := stmt.Exec(h.hash, s.idx.hasher.Name(), h.guid)
 		if err != nil {
 			fmt.Printf("  Warning: Failed to update hash for %s in DB: %v\n", h.guid, err)
 		} else {
@@ -246,66 +496,172 @@ func (s *Scanner) updateHashesInIndex(hashesToUpdate []struct{ guid, hash string
 	return nil
 }
 
-func (s *Scanner) findDuplicatesInHashGroup(hash string, filesInHashGroup []*FileItem) *ResultList {
-	if len(filesInHashGroup) < 2 {
+// Updates partial hash values in the database
+func (s *Scanner) updatePartialHashesInIndex(hashesToUpdate []struct{ guid, hash string }) error {
+	if len(hashesToUpdate) == 0 {
 		return nil
 	}
 
-	var actualDuplicatesThisGroup []*FileItem
-	actualDuplicatesThisGroup = append(actualDuplicatesThisGroup, filesInHashGroup[0])
+	tx, err := s.idx.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	results := make(chan struct {
-		file      *FileItem
-		identical bool
-		err       error
-	}, len(filesInHashGroup)-1)
+	stmt, err := tx.Prepare("UPDATE files SET partial_hash = ? WHERE guid = ?")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
 
-	for i := 1; i < len(filesInHashGroup); i++ {
-		wg.Add(1)
-		go func(fileToCompare *FileItem) {
-			defer wg.Done()
-			identical, err := compareFilesBinarySampleSize(filesInHashGroup[0].Path, fileToCompare.Path, s.idx.config.SampleSizeBinaryCompare)
-			results <- struct {
-				file      *FileItem
-				identical bool
-				err       error
-			}{fileToCompare, identical, err}
-		}(filesInHashGroup[i])
+	updatedCount := 0
+	for _, h := range hashesToUpdate {
+		_, err := stmt.Exec(h.hash, h.guid)
+		if err != nil {
+			fmt.Printf("  Warning: Failed to update partial hash for %s in DB: %v\n", h.guid, err)
+		} else {
+			updatedCount++
+		}
 	}
 
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if s.idx.config.Debug {
+		fmt.Printf("  Updated %d partial hashes in DB.\n", updatedCount)
+	}
+	return nil
+}
+
+// Splits a hash group into classes of identical files and returns every class of two or more files.
+// Files that have the hash but not the content of the others are reported, as a suspected hash collision
+// or as a file that changed during the scan.
+func (s *Scanner) findDuplicatesInHashGroup(hash string, filesInHashGroup []*FileItem) []*ResultList {
+	filesInHashGroup = collapseHardlinks(filesInHashGroup)
+	if len(filesInHashGroup) < 2 {
+		return nil
+	}
+
+	size := filesInHashGroup[0].Size
+	method := verifyMethod(size, s.idx.config)
+
+	var results []*ResultList
+	remaining := filesInHashGroup
+	for len(remaining) >= 2 {
+		class, different := s.splitHashGroup(remaining, size, method)
+		if len(class) >= 2 {
+			var duplicateGuids []string
+			for _, f := range class {
+				duplicateGuids = append(duplicateGuids, f.Guid)
+			}
+			results = append(results, &ResultList{
+				HashSum:       hash,
+				HashAlgorithm: s.idx.hasher.Name(),
+				Size:          size,
+				Method:        method,
+				FileGuids:     duplicateGuids,
+			})
+		}
+		remaining = different
+	}
+
+	return results
+}
 
-	for result := range results {
-		if result.err != nil {
-			fmt.Printf("  Warning: Failed to compare %s and %s: %v\n", filesInHashGroup[0].Path, result.file.Path, result.err)
+// Compares the files of a hash group with the first one. Returns the files identical to it, including itself,
+// and the files that differ from it. A comparison error only removes the file that failed: if the first file
+// can not be read, it is left out and the other files are returned as different, to be split by the next one.
+func (s *Scanner) splitHashGroup(filesInHashGroup []*FileItem, size int64, method string) ([]*FileItem, []*FileItem) {
+	first := filesInHashGroup[0]
+	if err := checkReadable(first.Path); err != nil {
+		fmt.Printf("  Warning: Failed to compare %s: %v\n", first.Path, err)
+		return nil, filesInHashGroup[1:]
+	}
+	identicalFiles := []*FileItem{first}
+	var differentFiles []*FileItem
+	var failedFiles []*FileItem
+	var failedErrs []error
+
+	// every file is compared with the first one, with a worker of the devices of both files
+	others := filesInHashGroup[1:]
+	identical := make([]bool, len(others))
+	errs := make([]error, len(others))
+	s.devices.run(len(others), func(i int) []string { return []string{first.Path, others[i].Path} }, func(i int) {
+		if errs[i] = s.ctx.Err(); errs[i] == nil {
+			identical[i], errs[i] = verifyFiles(s.ctx, first.Path, others[i].Path, size, method, s.idx.config)
+		}
+	})
+	// an interrupted group is verified again when the scan is resumed
+	if s.ctx.Err() != nil {
+		return nil, nil
+	}
+
+	for i, file := range others {
+		if errs[i] != nil {
+			failedFiles = append(failedFiles, file)
+			failedErrs = append(failedErrs, errs[i])
 			continue
 		}
-		if result.identical {
-			mu.Lock()
-			actualDuplicatesThisGroup = append(actualDuplicatesThisGroup, result.file)
-			mu.Unlock()
+		if identical[i] {
+			identicalFiles = append(identicalFiles, file)
+			continue
 		}
+		s.reportMismatch(first, file)
+		differentFiles = append(differentFiles, file)
 	}
 
-	if len(actualDuplicatesThisGroup) >= 2 {
-		var duplicateGuids []string
-		for _, f := range actualDuplicatesThisGroup {
-			duplicateGuids = append(duplicateGuids, f.Guid)
+	if len(failedFiles) > 0 {
+		if err := checkReadable(first.Path); err != nil {
+			// the first file failed during the comparisons, the files compared with it before are still
+			// identical to each other, the failed ones get compared again with the next file
+			fmt.Printf("  Warning: Failed to compare %s: %v\n", first.Path, err)
+			identicalFiles = identicalFiles[1:]
+			differentFiles = append(differentFiles, failedFiles...)
+		} else {
+			for i, file := range failedFiles {
+				fmt.Printf("  Warning: Failed to compare %s and %s: %v\n", first.Path, file.Path, failedErrs[i])
+			}
 		}
-		return &ResultList{
-			HashSum:   hash,
-			FileGuids: duplicateGuids,
+	}
+
+	// keep the order of the index, the first file of a group is the one kept by default
+	slices.SortFunc(identicalFiles, func(a, b *FileItem) int { return strings.Compare(a.Guid, b.Guid) })
+	slices.SortFunc(differentFiles, func(a, b *FileItem) int { return strings.Compare(a.Guid, b.Guid) })
+	return identicalFiles, differentFiles
+}
+
+// Checks that the file can be opened for reading
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Reports two files with the same hash and different content. If one of them no longer has the size and
+// modification time of the index, it changed during the scan, otherwise the hashes collide.
+func (s *Scanner) reportMismatch(a, b *FileItem) {
+	for _, file := range []*FileItem{a, b} {
+		if !fileUnchanged(file) {
+			fmt.Printf("  Warning: %s changed during the scan, it is no longer identical to %s\n", file.Path, otherFile(file, a, b).Path)
+			return
 		}
 	}
+	fmt.Printf("  Warning: Suspected %s hash collision, %s and %s have the same hash but different content\n",
+		s.idx.hasher.Name(), a.Path, b.Path)
+}
 
-	return nil
+// Returns the file of a and b that is not file
+func otherFile(file, a, b *FileItem) *FileItem {
+	if file == a {
+		return b
+	}
+	return a
 }
 
+// Stores a verified group and its files
 func (s *Scanner) addDuplicatesToIndex(resultList *ResultList) error {
 	if resultList == nil || len(resultList.FileGuids) < 2 {
 		return nil
@@ -318,10 +674,21 @@ func (s *Scanner) addDuplicatesToIndex(resultList *ResultList) error {
 	}
 	defer tx.Rollback()
 
+	result, err := tx.Exec(`
+        INSERT INTO groups (hash, hash_algorithm, size, verified_at, method, session_id)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, resultList.HashSum, resultList.HashAlgorithm, resultList.Size, now, resultList.Method, s.sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to add duplicate group: %w", err)
+	}
+	groupID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to add duplicate group: %w", err)
+	}
+
 	stmt, err := tx.Prepare(`
-        INSERT INTO duplicates (guid, scanned) 
-        VALUES (?, ?) 
-        ON CONFLICT(guid) DO UPDATE SET scanned = ?
+        INSERT INTO group_members (group_id, guid)
+        VALUES (?, ?)
     `)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
@@ -329,9 +696,9 @@ func (s *Scanner) addDuplicatesToIndex(resultList *ResultList) error {
 	defer stmt.Close()
 
 	for _, guid := range resultList.FileGuids {
-		_, err := stmt.Exec(guid, now, now)
+		_, err := stmt.Exec(groupID, guid)
 		if err != nil {
-			return fmt.Errorf("failed to update duplicate for %s: %w", guid, err)
+			return fmt.Errorf("failed to add duplicate %s to group: %w", guid, err)
 		}
 	}
 
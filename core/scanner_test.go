@@ -0,0 +1,135 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Writes the test files into a temporary directory and returns them as index entries, in the order of names.
+// A name without content is a file that does not exist.
+func writeTestFiles(t *testing.T, names []string, contents map[string]string) []*FileItem {
+	t.Helper()
+	dir := t.TempDir()
+	var files []*FileItem
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		content, exists := contents[name]
+		if exists {
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files = append(files, &FileItem{Guid: path, Path: path, Size: int64(len(content))})
+	}
+	return files
+}
+
+// Returns the names of the files of every group
+func groupNames(groups [][]*FileItem) [][]string {
+	var names [][]string
+	for _, group := range groups {
+		var groupNames []string
+		for _, file := range group {
+			groupNames = append(groupNames, filepath.Base(file.Path))
+		}
+		names = append(names, groupNames)
+	}
+	return names
+}
+
+func newTestScanner(t *testing.T) *Scanner {
+	t.Helper()
+	hasher, err := GetHasher(DefaultHashAlgorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{VerifyMode: VerifyFull, HDDWorkers: 1, SSDWorkers: 2}
+	return &Scanner{ctx: context.Background(), idx: &Index{config: config, hasher: hasher}, devices: newDeviceScheduler(config)}
+}
+
+func TestFindDuplicatesInHashGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents map[string]string
+		want     [][]string
+	}{
+		{
+			name:     "first file differs",
+			contents: map[string]string{"a": "other content", "b": "same content", "c": "same content", "d": "same content"},
+			want:     [][]string{{"b", "c", "d"}},
+		},
+		{
+			name:     "first file missing",
+			contents: map[string]string{"b": "same content", "c": "same content", "d": "same content"},
+			want:     [][]string{{"b", "c", "d"}},
+		},
+		{
+			name:     "class of three and a single file",
+			contents: map[string]string{"a": "same content", "b": "same content", "c": "other content", "d": "same content"},
+			want:     [][]string{{"a", "b", "d"}},
+		},
+		{
+			name:     "two classes",
+			contents: map[string]string{"a": "first content", "b": "other content", "c": "first content", "d": "other content"},
+			want:     [][]string{{"a", "c"}, {"b", "d"}},
+		},
+		{
+			name:     "different lengths with the same prefix",
+			contents: map[string]string{"a": "same content", "b": "same content and more", "c": "same content"},
+			want:     [][]string{{"a", "c"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestScanner(t)
+			files := writeTestFiles(t, []string{"a", "b", "c", "d"}, test.contents)
+			var groups [][]*FileItem
+			for _, result := range s.findDuplicatesInHashGroup("hash", files) {
+				var group []*FileItem
+				for _, guid := range result.FileGuids {
+					for _, file := range files {
+						if file.Guid == guid {
+							group = append(group, file)
+						}
+					}
+				}
+				groups = append(groups, group)
+			}
+			if got := groupNames(groups); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got groups %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitHashGroup(t *testing.T) {
+	s := newTestScanner(t)
+
+	// the first file is the reference, the files that differ from it are left for the next split
+	files := writeTestFiles(t, []string{"a", "b", "c"}, map[string]string{"a": "first content", "b": "other content", "c": "first content"})
+	identical, different := s.splitHashGroup(files, files[0].Size, VerifyFull)
+	if got := groupNames([][]*FileItem{identical, different}); !reflect.DeepEqual(got, [][]string{{"a", "c"}, {"b"}}) {
+		t.Errorf("got %v, want [[a c] [b]]", got)
+	}
+
+	// an unreadable first file is left out, the other files are returned to be split by the next one
+	files = writeTestFiles(t, []string{"a", "b", "c"}, map[string]string{"b": "same content", "c": "same content"})
+	identical, different = s.splitHashGroup(files, files[1].Size, VerifyFull)
+	if len(identical) != 0 {
+		t.Errorf("got identical files %v for a missing first file", groupNames([][]*FileItem{identical}))
+	}
+	if got := groupNames([][]*FileItem{different}); !reflect.DeepEqual(got, [][]string{{"b", "c"}}) {
+		t.Errorf("got different files %v, want [[b c]]", got)
+	}
+
+	// a file that fails is dropped, the others stay in their class
+	files = writeTestFiles(t, []string{"a", "b", "c"}, map[string]string{"a": "same content", "c": "same content"})
+	identical, different = s.splitHashGroup(files, files[0].Size, VerifyFull)
+	if got := groupNames([][]*FileItem{identical, different}); !reflect.DeepEqual(got, [][]string{{"a", "c"}, nil}) {
+		t.Errorf("got %v, want [[a c] []]", got)
+	}
+}
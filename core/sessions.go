@@ -0,0 +1,392 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Selects the groups of the latest finished scan session. Groups stored before scan sessions existed have no session,
+// they are current until the first session finishes.
+const currentGroupsCondition = `g.session_id IS (SELECT MAX(session_id) FROM scan_sessions WHERE finished_at IS NOT NULL)`
+
+// Settings a scan session ran with
+type ScanSettings struct {
+	HashAlgorithm    string
+	MinFileSize      int64
+	PartialHashSize  int64
+	PartialHashTail  bool
+	VerifyMethod     string
+	SampleBlockSize  int64 // Size of the blocks compared by the sample verify mode
+	SampleBlocks     int
+	LockstepMaxFiles int
+}
+
+// One run of ScanForDuplicates
+type ScanSession struct {
+	SessionID      int64
+	StartedAt      int64
+	FinishedAt     int64 // 0 if the scan did not finish
+	FileCount      int   // Files in the index when the scan started
+	GroupCount     int
+	DuplicateCount int   // Files in the groups, without one kept copy per group
+	WastedBytes    int64 // Size of the duplicate files
+	Settings       ScanSettings
+}
+
+// Creates a new, unfinished scan session and returns its id
+func (idx *Index) StartScanSession(settings ScanSettings, fileCount int) (int64, error) {
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode scan settings: %v", err)
+	}
+
+	result, err := idx.db.Exec(
+		"INSERT INTO scan_sessions (started_at, file_count, settings) VALUES (?, ?, ?)",
+		time.Now().Unix(), fileCount, string(settingsJSON),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start scan session: %v", err)
+	}
+	return result.LastInsertId()
+}
+
+// Marks the scan session as finished and stores the counts of its groups. From now on its groups are the current ones.
+func (idx *Index) FinishScanSession(sessionID int64) error {
+	_, err := idx.db.Exec(`
+		UPDATE scan_sessions SET
+			finished_at = ?2,
+			group_count = (SELECT COUNT(*) FROM groups WHERE session_id = ?1),
+			duplicate_count = (SELECT COALESCE(SUM(
+				(SELECT COUNT(*) - 1 FROM group_members m WHERE m.group_id = g.group_id)), 0)
+				FROM groups g WHERE g.session_id = ?1),
+			wasted_bytes = (SELECT COALESCE(SUM(g.size *
+				(SELECT COUNT(*) - 1 FROM group_members m WHERE m.group_id = g.group_id)), 0)
+				FROM groups g WHERE g.session_id = ?1)
+		WHERE session_id = ?1
+	`, sessionID, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to finish scan session: %v", err)
+	}
+	return nil
+}
+
+const scanSessionColumns = "session_id, started_at, finished_at, file_count, group_count, duplicate_count, wasted_bytes, settings"
+
+func scanScanSession(row interface{ Scan(...any) error }) (*ScanSession, error) {
+	var session ScanSession
+	var finishedAt sql.NullInt64
+	var settings sql.NullString
+	err := row.Scan(&session.SessionID, &session.StartedAt, &finishedAt, &session.FileCount,
+		&session.GroupCount, &session.DuplicateCount, &session.WastedBytes, &settings)
+	if err != nil {
+		return nil, err
+	}
+	session.FinishedAt = finishedAt.Int64
+	if settings.Valid {
+		if err := json.Unmarshal([]byte(settings.String), &session.Settings); err != nil {
+			return nil, fmt.Errorf("invalid settings of scan session %d: %v", session.SessionID, err)
+		}
+	}
+	return &session, nil
+}
+
+// Returns all scan sessions, oldest first
+func (idx *Index) GetScanSessions() ([]*ScanSession, error) {
+	rows, err := idx.db.Query("SELECT " + scanSessionColumns + " FROM scan_sessions ORDER BY session_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scan sessions: %v", err)
+	}
+	defer rows.Close()
+
+	var sessions []*ScanSession
+	for rows.Next() {
+		session, err := scanScanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// Returns the latest scan session if it did not finish, nil if it did
+func (idx *Index) GetInterruptedScanSession() (*ScanSession, error) {
+	row := idx.db.QueryRow("SELECT " + scanSessionColumns + " FROM scan_sessions ORDER BY session_id DESC LIMIT 1")
+	session, err := scanScanSession(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scan sessions: %v", err)
+	}
+	if session.FinishedAt != 0 {
+		return nil, nil
+	}
+	return session, nil
+}
+
+// Returns the scan session with the given id
+func (idx *Index) GetScanSession(sessionID int64) (*ScanSession, error) {
+	row := idx.db.QueryRow("SELECT "+scanSessionColumns+" FROM scan_sessions WHERE session_id = ?", sessionID)
+	session, err := scanScanSession(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no scan session %d", sessionID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query scan session %d: %v", sessionID, err)
+	}
+	return session, nil
+}
+
+// Returns the groups found by a scan session, with the paths of all files the scan found,
+// including files that were replaced or moved by actions later on
+func (idx *Index) GetSessionGroups(sessionID int64) ([]*GroupDiff, error) {
+	rows, err := idx.db.Query(`
+		SELECT g.group_id, g.hash, g.hash_algorithm, g.size, m.guid
+		FROM groups g
+		INNER JOIN group_members m ON g.group_id = m.group_id
+		WHERE g.session_id = ?
+		ORDER BY g.size DESC, g.group_id, m.guid
+	`, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query groups of scan session %d: %v", sessionID, err)
+	}
+	defer rows.Close()
+
+	var groups []*GroupDiff
+	lastGroupID := int64(-1)
+	for rows.Next() {
+		var group GroupDiff
+		var groupID int64
+		var hashAlgorithm sql.NullString
+		var path string
+		if err := rows.Scan(&groupID, &group.Hash, &hashAlgorithm, &group.Size, &path); err != nil {
+			return nil, fmt.Errorf("failed to scan group: %v", err)
+		}
+		group.HashAlgorithm = hashAlgorithm.String
+
+		if groupID == lastGroupID {
+			groups[len(groups)-1].Files = append(groups[len(groups)-1].Files, path)
+			continue
+		}
+		lastGroupID = groupID
+		group.Files = []string{path}
+		groups = append(groups, &group)
+	}
+	return groups, rows.Err()
+}
+
+// A duplicate group in the diff between two scan sessions
+type GroupDiff struct {
+	Hash          string
+	HashAlgorithm string
+	Size          int64
+	Files         []string // Files of the group, in the later session if the group still exists
+	Added         []string // Files that joined a changed group
+	Removed       []string // Files that left a changed group
+}
+
+// Content of the group, a group of the later session matches a group of the earlier one with the same content
+// and common files. Since several classes of identical files may share a hash, the content alone is not unique.
+func (g *GroupDiff) key() string {
+	return g.HashAlgorithm + ":" + g.Hash + ":" + strconv.FormatInt(g.Size, 10)
+}
+
+// Differences between the groups of two scan sessions
+type ScanDiff struct {
+	From     *ScanSession
+	To       *ScanSession
+	New      []*GroupDiff // Groups only found by the later session
+	Resolved []*GroupDiff // Groups only found by the earlier session
+	Changed  []*GroupDiff // Groups found by both sessions, with different files
+}
+
+// Compares the groups of two scan sessions
+func (idx *Index) DiffScanSessions(fromID, toID int64) (*ScanDiff, error) {
+	diff := &ScanDiff{}
+	var err error
+	if diff.From, err = idx.GetScanSession(fromID); err != nil {
+		return nil, err
+	}
+	if diff.To, err = idx.GetScanSession(toID); err != nil {
+		return nil, err
+	}
+
+	fromGroups, err := idx.GetSessionGroups(fromID)
+	if err != nil {
+		return nil, err
+	}
+	toGroups, err := idx.GetSessionGroups(toID)
+	if err != nil {
+		return nil, err
+	}
+
+	fromByKey := make(map[string][]*GroupDiff)
+	for _, group := range fromGroups {
+		fromByKey[group.key()] = append(fromByKey[group.key()], group)
+	}
+	matched := make(map[*GroupDiff]bool)
+
+	for _, group := range toGroups {
+		previous := matchingGroup(group, fromByKey[group.key()], matched)
+		if previous == nil {
+			diff.New = append(diff.New, group)
+			continue
+		}
+		matched[previous] = true
+
+		for _, path := range group.Files {
+			if !slices.Contains(previous.Files, path) {
+				group.Added = append(group.Added, path)
+			}
+		}
+		for _, path := range previous.Files {
+			if !slices.Contains(group.Files, path) {
+				group.Removed = append(group.Removed, path)
+			}
+		}
+		if len(group.Added) > 0 || len(group.Removed) > 0 {
+			diff.Changed = append(diff.Changed, group)
+		}
+	}
+
+	// keep the order of the earlier session for resolved groups
+	for _, group := range fromGroups {
+		if !matched[group] {
+			diff.Resolved = append(diff.Resolved, group)
+		}
+	}
+
+	return diff, nil
+}
+
+// Returns the candidate not matched yet that has the most files in common with group, nil if none has any
+func matchingGroup(group *GroupDiff, candidates []*GroupDiff, matched map[*GroupDiff]bool) *GroupDiff {
+	var best *GroupDiff
+	bestCommon := 0
+	for _, candidate := range candidates {
+		if matched[candidate] {
+			continue
+		}
+		common := 0
+		for _, path := range group.Files {
+			if slices.Contains(candidate.Files, path) {
+				common++
+			}
+		}
+		if common > bestCommon {
+			best, bestCommon = candidate, common
+		}
+	}
+	return best
+}
+
+// Lists all scan sessions
+func (a *App) ShowScanSessions() {
+	sessions, err := a.index.GetScanSessions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(sessions) == 0 {
+		fmt.Println("No scan sessions in database")
+		return
+	}
+
+	for _, session := range sessions {
+		status := fmt.Sprintf("%d groups, %d duplicates, %s wasted", session.GroupCount, session.DuplicateCount, HumanizeBytes(session.WastedBytes))
+		if session.FinishedAt == 0 {
+			status = "not finished"
+		}
+		fmt.Printf("%4d  %s  %d files  %s  (%s, %s)\n", session.SessionID,
+			time.Unix(session.StartedAt, 0).Format("2006-01-02 15:04:05"), session.FileCount, status,
+			session.Settings.HashAlgorithm, session.Settings.VerifyMethod)
+	}
+	fmt.Printf("Scan sessions in database: %d total.\n", len(sessions))
+}
+
+// Shows the new, resolved and changed groups between two scan sessions.
+// Without to the latest finished session is used.
+func (a *App) ShowScanDiff(from, to string, asJSON bool) {
+	fromID, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid scan session %q\n", from)
+		os.Exit(1)
+	}
+
+	var toID int64
+	if to == "" {
+		toID, err = a.latestScanSession()
+	} else {
+		toID, err = strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("invalid scan session %q", to)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	diff, err := a.index.DiffScanSessions(fromID, toID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if asJSON {
+		jsonData, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to marshal JSON: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(jsonData))
+		return
+	}
+
+	fmt.Printf("Scan session %d (%s) -> %d (%s)\n",
+		diff.From.SessionID, time.Unix(diff.From.StartedAt, 0).Format("2006-01-02 15:04:05"),
+		diff.To.SessionID, time.Unix(diff.To.StartedAt, 0).Format("2006-01-02 15:04:05"))
+
+	for _, group := range diff.New {
+		fmt.Printf("\nNew group (%d files of %s, %s %s):\n", len(group.Files), HumanizeBytes(group.Size), group.HashAlgorithm, group.Hash)
+		for _, path := range group.Files {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+	for _, group := range diff.Resolved {
+		fmt.Printf("\nResolved group (%d files of %s, %s %s):\n", len(group.Files), HumanizeBytes(group.Size), group.HashAlgorithm, group.Hash)
+		for _, path := range group.Files {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+	for _, group := range diff.Changed {
+		fmt.Printf("\nChanged group (%d files of %s, %s %s):\n", len(group.Files), HumanizeBytes(group.Size), group.HashAlgorithm, group.Hash)
+		for _, path := range group.Added {
+			fmt.Printf("  + %s\n", path)
+		}
+		for _, path := range group.Removed {
+			fmt.Printf("  - %s\n", path)
+		}
+	}
+
+	fmt.Printf("\nSummary: %d new, %d resolved, %d changed groups\n", len(diff.New), len(diff.Resolved), len(diff.Changed))
+}
+
+// Returns the id of the latest finished scan session
+func (a *App) latestScanSession() (int64, error) {
+	var sessionID sql.NullInt64
+	err := a.index.db.QueryRow("SELECT MAX(session_id) FROM scan_sessions WHERE finished_at IS NOT NULL").Scan(&sessionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query scan sessions: %v", err)
+	}
+	if !sessionID.Valid {
+		return 0, fmt.Errorf("no finished scan session")
+	}
+	return sessionID.Int64, nil
+}
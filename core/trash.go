@@ -0,0 +1,472 @@
+package core
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The FreeDesktop.org trash specification is used everywhere except on macOS and Windows,
+// where duplicates are moved into the system trash directory as they are.
+var freeDesktopTrash = runtime.GOOS != "darwin" && runtime.GOOS != "windows"
+
+const trashInfoExtension = ".trashinfo"
+const trashInfoDateFormat = "2006-01-02T15:04:05"
+
+// A file in a trash directory, described by its .trashinfo file
+type TrashItem struct {
+	TrashDir     string // Trash directory containing the files and info directories
+	Name         string // Name of the file in the files directory
+	OriginalPath string
+	DeletionDate time.Time
+}
+
+// Returns the path of the trashed file
+func (t *TrashItem) FilesPath() string {
+	return filepath.Join(t.TrashDir, "files", t.Name)
+}
+
+// Returns the path of the .trashinfo file
+func (t *TrashItem) InfoPath() string {
+	return filepath.Join(t.TrashDir, "info", t.Name+trashInfoExtension)
+}
+
+// Returns the home trash directory, $XDG_DATA_HOME/Trash or ~/.local/share/Trash
+func homeTrashDir() string {
+	if xdgDataHome := os.Getenv("XDG_DATA_HOME"); xdgDataHome != "" {
+		return filepath.Join(xdgDataHome, "Trash")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".local/share/Trash")
+}
+
+// Returns the trash directory for the file and creates it, see findTrashDir
+func trashDirFor(path string) (string, error) {
+	trashDir, fallback, err := findTrashDir(path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(trashDir, 0700); err != nil {
+		if fallback == "" {
+			return "", err
+		}
+		if err := os.MkdirAll(fallback, 0700); err != nil {
+			return "", err
+		}
+		return fallback, nil
+	}
+	return trashDir, nil
+}
+
+// Returns the trash directory for the file without creating anything. Files on the volume of the home
+// trash go there, files on other volumes go to $topdir/.Trash/$uid if the administrator created $topdir/.Trash,
+// otherwise to $topdir/.Trash-$uid. The fallback is the directory to use if the first one can not be created.
+func findTrashDir(path string) (string, string, error) {
+	homeTrash := homeTrashDir()
+	// the home trash might not exist yet, it is created on the volume of its first existing parent
+	same, err := sameFilesystem(existingParent(homeTrash), path)
+	if err != nil {
+		return "", "", err
+	}
+	if same {
+		return homeTrash, "", nil
+	}
+
+	topDir, err := volumeTopDir(path)
+	if err != nil {
+		return "", "", err
+	}
+	uid := strconv.Itoa(os.Getuid())
+	userTrash := filepath.Join(topDir, ".Trash-"+uid)
+
+	// the shared trash must be a real directory with the sticky bit set, otherwise it is not safe to use
+	sharedTrash := filepath.Join(topDir, ".Trash")
+	if info, err := os.Lstat(sharedTrash); err == nil {
+		if info.IsDir() && info.Mode()&os.ModeSticky != 0 {
+			return filepath.Join(sharedTrash, uid), userTrash, nil
+		}
+		fmt.Printf("Warning: %s is not a directory with the sticky bit set, ignoring it\n", sharedTrash)
+	}
+	return userTrash, "", nil
+}
+
+// Returns path or the closest of its parent directories that exists
+func existingParent(path string) string {
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// Returns the trash directories of the home trash and of every mounted volume
+func trashDirs() []string {
+	dirs := []string{homeTrashDir()}
+	uid := strconv.Itoa(os.Getuid())
+	for _, topDir := range mountPoints() {
+		dirs = append(dirs, filepath.Join(topDir, ".Trash", uid), filepath.Join(topDir, ".Trash-"+uid))
+	}
+
+	var existing []string
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if info, err := os.Stat(filepath.Join(dir, "info")); err == nil && info.IsDir() {
+			existing = append(existing, dir)
+		}
+	}
+	return existing
+}
+
+// Returns the mount points listed in /proc/self/mounts, or nothing if it is not available
+func mountPoints() []string {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// spaces and other special characters are octal escaped
+		mountPoint, err := strconv.Unquote(`"` + strings.ReplaceAll(fields[1], `"`, `\"`) + `"`)
+		if err != nil {
+			mountPoint = fields[1]
+		}
+		mounts = append(mounts, mountPoint)
+	}
+	return mounts
+}
+
+// Moves the file into its trash directory and writes the .trashinfo file next to it.
+// Returns the path of the trashed file.
+func trashFile(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	trashDir, err := trashDirFor(absPath)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(trashDir, dir), 0700); err != nil {
+			return "", err
+		}
+	}
+
+	// the home trash stores absolute paths, the trash of a volume paths relative to its top directory
+	infoPath := absPath
+	if trashDir != homeTrashDir() {
+		topDir, err := volumeTopDir(absPath)
+		if err != nil {
+			return "", err
+		}
+		if rel, err := filepath.Rel(topDir, absPath); err == nil {
+			infoPath = filepath.ToSlash(rel)
+		}
+	}
+
+	item, err := reserveTrashName(trashDir, filepath.Base(absPath), infoPath, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(absPath, item.FilesPath()); err != nil {
+		os.Remove(item.InfoPath())
+		return "", err
+	}
+	return item.FilesPath(), nil
+}
+
+// Creates the .trashinfo file under an unused name. Creating it exclusively reserves the name
+// in the files directory as well, as required by the specification.
+func reserveTrashName(trashDir, baseName, originalPath string, deletionDate time.Time) (*TrashItem, error) {
+	ext := filepath.Ext(baseName)
+	name := baseName[:len(baseName)-len(ext)]
+	content := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: originalPath}).EscapedPath(), deletionDate.Format(trashInfoDateFormat))
+
+	for i := 1; ; i++ {
+		item := &TrashItem{TrashDir: trashDir, Name: baseName, OriginalPath: originalPath, DeletionDate: deletionDate}
+		if i > 1 {
+			item.Name = fmt.Sprintf("%s.%d%s", name, i, ext)
+		}
+		if _, err := os.Lstat(item.FilesPath()); err == nil {
+			continue
+		}
+
+		f, err := os.OpenFile(item.InfoPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.WriteString(content); err != nil {
+			f.Close()
+			os.Remove(item.InfoPath())
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(item.InfoPath())
+			return nil, err
+		}
+		return item, nil
+	}
+}
+
+// Reads a .trashinfo file. Relative original paths are resolved against the top directory of the trash.
+func readTrashInfo(trashDir, infoFile string) (*TrashItem, error) {
+	f, err := os.Open(infoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	item := &TrashItem{
+		TrashDir: trashDir,
+		Name:     strings.TrimSuffix(filepath.Base(infoFile), trashInfoExtension),
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "Path":
+			path, err := url.PathUnescape(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path in %s: %v", infoFile, err)
+			}
+			item.OriginalPath = filepath.FromSlash(path)
+		case "DeletionDate":
+			date, err := time.ParseInLocation(trashInfoDateFormat, value, time.Local)
+			if err == nil {
+				item.DeletionDate = date
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if item.OriginalPath == "" {
+		return nil, fmt.Errorf("no path in %s", infoFile)
+	}
+
+	if !filepath.IsAbs(item.OriginalPath) {
+		item.OriginalPath = filepath.Join(trashTopDir(trashDir), item.OriginalPath)
+	}
+	return item, nil
+}
+
+// Returns the top directory of a volume trash directory
+func trashTopDir(trashDir string) string {
+	parent := filepath.Dir(trashDir)
+	if filepath.Base(parent) == ".Trash" {
+		return filepath.Dir(parent)
+	}
+	return parent
+}
+
+// Returns the .trashinfo file belonging to a file in the files directory of a trash
+func trashInfoPathFor(filesPath string) string {
+	trashDir := filepath.Dir(filepath.Dir(filesPath))
+	return filepath.Join(trashDir, "info", filepath.Base(filesPath)+trashInfoExtension)
+}
+
+// Returns all files in the trash directories, oldest first
+func listTrashItems() []*TrashItem {
+	var items []*TrashItem
+	for _, trashDir := range trashDirs() {
+		infoFiles, err := filepath.Glob(filepath.Join(trashDir, "info", "*"+trashInfoExtension))
+		if err != nil {
+			continue
+		}
+		for _, infoFile := range infoFiles {
+			item, err := readTrashInfo(trashDir, infoFile)
+			if err != nil {
+				fmt.Printf("Warning: %v\n", err)
+				continue
+			}
+			if _, err := os.Lstat(item.FilesPath()); err != nil {
+				continue
+			}
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].DeletionDate.Before(items[j].DeletionDate)
+	})
+	return items
+}
+
+// Moves the files of each decision to the trash of their volume
+func (a *App) trashDuplicateFiles(decisions []keepDecision) {
+	trashedCount := 0
+	operation := a.newOperation(ActionTrash)
+
+	for _, decision := range decisions {
+		for _, file := range decision.rest {
+			if a.config.DryRun {
+				trashDir, _, err := findTrashDir(file.Path)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error trashing %s: %v\n", file.Path, err)
+					continue
+				}
+				fmt.Printf("Would trash %s to %s\n", file.Path, trashDir)
+				continue
+			}
+
+			trashedPath, err := trashFile(file.Path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error trashing %s: %v\n", file.Path, err)
+				continue
+			}
+			operation.record(file, file.Path, trashedPath)
+
+			// trashed files are no longer indexed, restoring them adds them again
+			if _, err := a.index.RemoveFiles([]string{file.Guid}); err != nil {
+				fmt.Fprintf(os.Stderr, "Error updating database for %s: %v\n", file.Path, err)
+			}
+
+			trashedCount++
+		}
+	}
+
+	fmt.Printf("Moved %d duplicate files to trash\n", trashedCount)
+	operation.finish()
+}
+
+// Lists all files in the trash directories
+func (a *App) ShowTrash() {
+	if !freeDesktopTrash {
+		fmt.Fprintf(os.Stderr, "Error: Listing the trash is only supported for FreeDesktop.org trash directories\n")
+		os.Exit(1)
+	}
+
+	items := listTrashItems()
+	if len(items) == 0 {
+		fmt.Println("No files in trash")
+		return
+	}
+	for _, item := range items {
+		fmt.Printf("%s  %s  (%s)\n", item.DeletionDate.Format("2006-01-02 15:04:05"), item.OriginalPath, item.FilesPath())
+	}
+	fmt.Printf("Files in trash: %d total.\n", len(items))
+}
+
+// Restores trashed files to their original path. path is either the original path of a file
+// or a directory, then every trashed file from inside it is restored.
+// If a path was trashed more than once, the latest file is restored.
+func (a *App) RestoreFromTrash(path string) {
+	if !freeDesktopTrash {
+		fmt.Fprintf(os.Stderr, "Error: Restoring is only supported for FreeDesktop.org trash directories\n")
+		os.Exit(1)
+	}
+	if path == "" {
+		fmt.Fprintf(os.Stderr, "Error: No path specified\n")
+		os.Exit(1)
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// newest item per original path, items are sorted oldest first
+	latest := make(map[string]*TrashItem)
+	for _, item := range listTrashItems() {
+		if isPathUnder(item.OriginalPath, absPath) {
+			latest[item.OriginalPath] = item
+		}
+	}
+	if len(latest) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: No trashed files found for %s\n", absPath)
+		os.Exit(1)
+	}
+
+	originalPaths := make([]string, 0, len(latest))
+	for originalPath := range latest {
+		originalPaths = append(originalPaths, originalPath)
+	}
+	sort.Strings(originalPaths)
+
+	restoredCount := 0
+	for _, originalPath := range originalPaths {
+		item := latest[originalPath]
+		if a.config.DryRun {
+			fmt.Printf("Would restore %s from %s\n", originalPath, item.FilesPath())
+			continue
+		}
+
+		if err := restoreTrashItem(item); err != nil {
+			fmt.Fprintf(os.Stderr, "Error restoring %s: %v\n", originalPath, err)
+			continue
+		}
+
+		// files trashed by an operation are indexed again, the operation can not undo them a second time
+		entry, err := a.index.FindJournalEntry(ActionTrash, item.FilesPath())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		if entry != nil {
+			a.reindexRestoredFile(originalPath)
+			if err := a.index.MarkJournalEntryUndone(entry.ID); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
+
+		fmt.Printf("Restored %s\n", originalPath)
+		restoredCount++
+	}
+
+	fmt.Printf("Restored %d files from trash\n", restoredCount)
+}
+
+// Adds a file restored from the trash to the index again, it was removed when it was trashed
+func (a *App) reindexRestoredFile(path string) {
+	info, err := os.Stat(path)
+	if err == nil {
+		err = a.index.AddFileItems([]*FileItem{newFileItem(path, info)})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error updating database for %s: %v\n", path, err)
+	}
+}
+
+// Moves a trashed file back to its original path and removes its .trashinfo file
+func restoreTrashItem(item *TrashItem) error {
+	if _, err := os.Lstat(item.OriginalPath); err == nil {
+		return fmt.Errorf("original path exists already")
+	}
+	if err := os.MkdirAll(filepath.Dir(item.OriginalPath), 0755); err != nil {
+		return err
+	}
+	// the original directory may be on another volume by now
+	if err := moveFile(item.FilesPath(), item.OriginalPath, sql.NullString{}, sql.NullString{}); err != nil {
+		return err
+	}
+	return os.Remove(item.InfoPath())
+}
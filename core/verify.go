@@ -0,0 +1,55 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Verify modes, they decide how the files of a hash group are compared before they count as duplicates
+const (
+	VerifyFull     = "full"      // Compare the whole content, chunk by chunk
+	VerifySample   = "sample"    // Compare a fixed set of blocks spread across the files
+	VerifyHashOnly = "hash-only" // Trust the hash, compare nothing
+)
+
+const DefaultSampleBlockSize = 64 * 1024 // 64KB
+const DefaultSampleBlocks = 16
+
+// Seed of the block positions of the sample verify mode. Files of the same size always get the same blocks
+// compared, so a scan can be repeated with the same result.
+const sampleSeed = 0x6466
+
+// Returns the names of all verify modes
+func VerifyModeNames() []string {
+	return []string{VerifyFull, VerifyHashOnly, VerifySample}
+}
+
+// Returns an error if the verify mode is unknown
+func checkVerifyMode(mode string) error {
+	if !slices.Contains(VerifyModeNames(), mode) {
+		return fmt.Errorf("unknown verify mode %q (available: %s)", mode, strings.Join(VerifyModeNames(), ", "))
+	}
+	return nil
+}
+
+// Returns the method the verify mode uses for files of the size: sampling a file that has no more blocks
+// than the sample compares it fully
+func verifyMethod(size int64, config *Config) string {
+	if config.VerifyMode == VerifySample && sampleOffsets(size, config.SampleBlockSize, config.SampleBlocks) == nil {
+		return VerifyFull
+	}
+	return config.VerifyMode
+}
+
+// Compares two files of the same size with the method of verifyMethod
+func verifyFiles(ctx context.Context, pathA, pathB string, size int64, method string, config *Config) (bool, error) {
+	switch method {
+	case VerifyHashOnly:
+		return true, nil
+	case VerifySample:
+		return CompareFilesSampled(ctx, pathA, pathB, sampleOffsets(size, config.SampleBlockSize, config.SampleBlocks), config.SampleBlockSize)
+	}
+	return CompareFilesBinary(ctx, pathA, pathB)
+}
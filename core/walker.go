@@ -0,0 +1,235 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Number of files the walker collects before passing them on
+const walkBatchSize = 1000
+
+// Walks a directory tree with a pool of workers. Every worker reads whole directories with os.ReadDir,
+// subdirectories are queued for the next free worker and the found files are passed on in batches.
+type walker struct {
+	root       string
+	recursive  bool
+	filter     *Filter
+	ignoreFile string // Global ignore file
+	workers    int
+	debug      bool
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []walkJob // Directories waiting for a worker
+	pending int       // Directories queued or being read
+	stopped bool
+}
+
+// A directory to read and the ignore files of its parent directories
+type walkJob struct {
+	path   string
+	ignore *ignoreList
+}
+
+// Creates a walker for the file or directory with the configured number of workers
+func (a *App) newWalker(root string, recursive bool, filter *Filter) *walker {
+	workers := a.config.WalkWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	w := &walker{
+		root:       root,
+		recursive:  recursive,
+		filter:     filter,
+		ignoreFile: a.config.IgnoreFilename,
+		workers:    workers,
+		debug:      a.config.Debug,
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// Walks the tree and calls fn with every batch of files. fn is called by the calling goroutine only.
+// An error returned by fn stops the walk and is returned. Unreadable directories are skipped.
+func (w *walker) walk(fn func([]*FileItem) error) error {
+	info, err := os.Stat(w.root)
+	if err != nil {
+		return err
+	}
+
+	// a single file is checked by its name
+	if !info.IsDir() {
+		dir := filepath.Dir(w.root)
+		if newIgnoreBase(dir, w.ignoreFile).enter(dir).ignores(w.root, false) != nil {
+			return nil
+		}
+		if included, _ := w.filter.MatchFile(filepath.Base(w.root), info.Size(), info.ModTime().Unix()); !included {
+			return nil
+		}
+		return fn([]*FileItem{newFileItem(w.root, info)})
+	}
+
+	batches := make(chan []*FileItem, w.workers)
+	var wg sync.WaitGroup
+
+	w.push(walkJob{path: w.root, ignore: newIgnoreBase(w.root, w.ignoreFile)})
+	for range w.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work(batches)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+
+	var fnErr error
+	for batch := range batches {
+		if fnErr != nil {
+			continue // let the workers finish
+		}
+		if fnErr = fn(batch); fnErr != nil {
+			w.stop()
+		}
+	}
+	return fnErr
+}
+
+// Reads directories until the queue is empty and no other worker can queue new ones
+func (w *walker) work(batches chan<- []*FileItem) {
+	var batch []*FileItem
+	for {
+		job, ok := w.pop()
+		if !ok {
+			break
+		}
+		batch = w.readDir(job, batch)
+		if len(batch) >= walkBatchSize {
+			batches <- batch
+			batch = nil
+		}
+		w.done()
+	}
+	if len(batch) > 0 {
+		batches <- batch
+	}
+}
+
+// Reads one directory, queues its subdirectories and appends its files to batch
+func (w *walker) readDir(job walkJob, batch []*FileItem) []*FileItem {
+	entries, err := os.ReadDir(job.path)
+	if err != nil {
+		if w.debug {
+			fmt.Printf("Debug: Skipping directory %s: %v\n", job.path, err)
+		}
+		return batch
+	}
+
+	// rules of the .dfignore in this directory apply to its content
+	ignore := job.ignore.enter(job.path)
+
+	for _, entry := range entries {
+		path := filepath.Join(job.path, entry.Name())
+		relPath, err := filepath.Rel(w.root, path)
+		if err != nil {
+			continue
+		}
+
+		if entry.IsDir() {
+			if !w.recursive {
+				continue
+			}
+			if walked, reason := w.filter.MatchDir(relPath); !walked {
+				if w.debug {
+					fmt.Printf("Debug: Skipping directory %s, %s\n", path, reason)
+				}
+				continue
+			}
+			if rule := ignore.ignores(path, true); rule != nil {
+				if w.debug {
+					fmt.Printf("Debug: Skipping directory %s, ignored by %s\n", path, rule.source)
+				}
+				continue
+			}
+			w.push(walkJob{path: path, ignore: ignore})
+			continue
+		}
+		// symbolic links, like the ones --symlink replaces duplicates with, are no files of their own
+		if entry.Type()&os.ModeSymlink != 0 {
+			continue
+		}
+
+		if ignore.ignores(path, false) != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // Skip errors, e.g. files deleted during the walk
+		}
+		if included, _ := w.filter.MatchFile(relPath, info.Size(), info.ModTime().Unix()); !included {
+			continue
+		}
+		batch = append(batch, newFileItem(path, info))
+	}
+	return batch
+}
+
+func (w *walker) push(job walkJob) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.queue = append(w.queue, job)
+	w.pending++
+	w.cond.Signal()
+}
+
+// Returns the next directory to read. Waits while the queue is empty but other workers still read directories.
+// The newest directory comes first, so the queue stays small on deep trees.
+func (w *walker) pop() (walkJob, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.queue) == 0 && w.pending > 0 && !w.stopped {
+		w.cond.Wait()
+	}
+	if w.stopped || len(w.queue) == 0 {
+		return walkJob{}, false
+	}
+	job := w.queue[len(w.queue)-1]
+	w.queue = w.queue[:len(w.queue)-1]
+	return job, true
+}
+
+// Marks a directory of pop as read
+func (w *walker) done() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending--
+	if w.pending == 0 {
+		w.cond.Broadcast()
+	}
+}
+
+func (w *walker) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	w.cond.Broadcast()
+}
+
+// Creates the index entry of a file found by a walk
+func newFileItem(path string, info os.FileInfo) *FileItem {
+	return &FileItem{
+		Guid:          filepath.Clean(path),
+		Path:          path,
+		Extension:     strings.TrimPrefix(filepath.Ext(path), "."),
+		Size:          info.Size(),
+		HumanizedSize: HumanizeBytes(info.Size()),
+		ModTime:       info.ModTime().Unix(),
+		Hash:          sql.NullString{String: "", Valid: false},
+	}
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Writes the files of the tree, a name ending with / is a directory
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The walker must find the same files as the sequential walk, with the same filter and ignore rules
+func TestWalkerMatchesSequentialWalk(t *testing.T) {
+	content := strings.Repeat("x", 100)
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".dfignore":            "*.tmp\n!keep.tmp\nbuild/\n",
+		"a.jpg":                content,
+		"b.tmp":                content,
+		"keep.tmp":             content,
+		"small.jpg":            "tiny",
+		"z.bak":                content,
+		"build/x.jpg":          content,
+		"node_modules/y.jpg":   content,
+		"sub/.dfignore":        "/c.jpg\n",
+		"sub/c.jpg":            content,
+		"sub/d.jpg":            content,
+		"sub/deep/c.jpg":       content,
+		"sub/deep/e.jpg":       content,
+		"sub/deep/e.log":       content,
+		"sub/deep/empty/":      "",
+		"sub/deep/b.tmp":       content,
+		"sub/deep/.dfignore":   "!b.tmp\n",
+		"other/thumbs/t.jpg":   content,
+		"other/thumbs/t.png":   content,
+		"other/pictures/t.jpg": content,
+	})
+	if err := os.Symlink(filepath.Join(root, "a.jpg"), filepath.Join(root, "link.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	globalIgnore := filepath.Join(t.TempDir(), "ignore")
+	if err := os.WriteFile(globalIgnore, []byte("*.bak\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := NewFilter(FilterOptions{
+		Exclude:     []string{"*.log", "**/thumbs/*.jpg"},
+		ExcludeDirs: []string{"node_modules"},
+		MinSize:     "50",
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.jpg", "keep.tmp", "other/pictures/t.jpg", "other/thumbs/t.png", "sub/d.jpg", "sub/deep/b.tmp", "sub/deep/c.jpg", "sub/deep/e.jpg"}
+
+	a := &App{config: &Config{IgnoreFilename: globalIgnore}}
+	fileItems, err := a.getFileInfos(root, true, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sequential := make(map[string]*FileItem)
+	for _, file := range fileItems {
+		sequential[file.Guid] = file
+	}
+	if got := relativeGuids(t, root, sequential); !slices.Equal(got, want) {
+		t.Fatalf("sequential walk found %v, want %v", got, want)
+	}
+
+	for _, workers := range []int{1, 4} {
+		a := &App{config: &Config{IgnoreFilename: globalIgnore, WalkWorkers: workers}}
+		walked := make(map[string]*FileItem)
+		err := a.newWalker(root, true, filter).walk(func(batch []*FileItem) error {
+			for _, file := range batch {
+				walked[file.Guid] = file
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if differences := compareFileItems(sequential, walked); differences > 0 {
+			t.Errorf("walker with %d workers found %v, %d files differ from the sequential walk", workers, relativeGuids(t, root, walked), differences)
+		}
+	}
+}
+
+// Returns the sorted guids of the files relative to root, with slashes
+func relativeGuids(t *testing.T, root string, files map[string]*FileItem) []string {
+	t.Helper()
+	var guids []string
+	for guid := range files {
+		rel, err := filepath.Rel(root, guid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		guids = append(guids, filepath.ToSlash(rel))
+	}
+	slices.Sort(guids)
+	return guids
+}
+
+// Compares the sequential walk with the walker and different numbers of workers on the tree --benchmark-walk
+// generates. Only the walk is timed, no database is involved.
+func BenchmarkWalk(b *testing.B) {
+	dir := b.TempDir()
+	count, err := generateBenchmarkTree(dir, benchmarkDirDepth)
+	if err != nil {
+		b.Fatal(err)
+	}
+	filter := &Filter{}
+
+	b.Run("sequential", func(b *testing.B) {
+		a := &App{config: &Config{}}
+		for b.Loop() {
+			files, err := a.getFileInfos(dir, true, filter)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(files) != count {
+				b.Fatalf("found %d files, expected %d", len(files), count)
+			}
+		}
+	})
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			a := &App{config: &Config{WalkWorkers: workers}}
+			for b.Loop() {
+				found := 0
+				err := a.newWalker(dir, true, filter).walk(func(batch []*FileItem) error {
+					found += len(batch)
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if found != count {
+					b.Fatalf("found %d files, expected %d", found, count)
+				}
+			}
+		})
+	}
+}
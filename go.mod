@@ -2,4 +2,11 @@ module df
 
 go 1.24
 
-require github.com/mattn/go-sqlite3 v1.14.28
+require (
+	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/zeebo/blake3 v0.2.4
+	github.com/zeebo/xxh3 v1.1.0
+	golang.org/x/sys v0.30.0
+)
+
+require github.com/klauspost/cpuid/v2 v2.2.10 // indirect
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"df/core"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 func main() {
@@ -11,29 +16,130 @@ func main() {
 
 	// flags
 	var (
-		addPath     = flag.String("add", "", "Add path to database")
-		removePath  = flag.String("remove", "", "Remove path from database")
-		showConfig  = flag.Bool("config", false, "Show configuration")
-		showFiles   = flag.Bool("files", false, "Show all files in database")
-		showDupes   = flag.Bool("dupes", false, "Show all duplicate files in database")
-		showHashes  = flag.Bool("hashes", false, "Show file hashes in the database")
-		scan        = flag.Bool("scan", false, "StartScan for duplicates")
-		export      = flag.Bool("export", false, "Export duplicate files to STDOUT")
-		exportjson  = flag.String("export-json", "", "Export duplicate files to a filename")
-		exportcsv   = flag.String("export-csv", "", "Export duplicate files to a filename")
-		clearindex  = flag.Bool("clear", false, "Clear all files in database")
-		purgeIndex  = flag.Bool("purgeIndex", false, "Remove non-existing files from database")
-		updateIndex = flag.Bool("updateIndex", false, "Updates file hashes in the database")
-		quickScan   = flag.String("qs", "", "Add path to database and scan for duplicates (example: ./df --qs /home/user/photos)")
-		move        = flag.String("move", "", "Move duplicate files to a new directory")
-		trash       = flag.Bool("trash", false, "Move duplicate files to trash")
-		forget      = flag.Bool("forget", false, "Remove duplicate files from database")
-		headshot    = flag.Bool("headshot", false, "Remove hashes from database")
+		addPath      = flag.String("add", "", "Add path to database")
+		removePath   = flag.String("remove", "", "Remove path from database")
+		recursive    = flag.Bool("recursive", true, "Add the files of subdirectories too (--add, --qs, --root-add)")
+		roots        = flag.Bool("roots", false, "Show all roots (directories added to the database)")
+		rootAdd      = flag.String("root-add", "", "Add a directory as root and index its files (example: ./df --label photos --root-add /data/photos)")
+		rootRemove   = flag.String("root-remove", "", "Remove a root, given by path or label, and its files from database")
+		rootLabel    = flag.String("label", "", "Label of the root added with --root-add")
+		rescanRoots  = flag.Bool("rescan-roots", false, "Walk all roots again, add new files and remove vanished ones")
+		showConfig   = flag.Bool("config", false, "Show configuration")
+		showFiles    = flag.Bool("files", false, "Show all files in database")
+		showDupes    = flag.Bool("dupes", false, "Show all duplicate files in database")
+		showHashes   = flag.Bool("hashes", false, "Show file hashes in the database")
+		scan         = flag.Bool("scan", false, "StartScan for duplicates")
+		export       = flag.Bool("export", false, "Export duplicate files to STDOUT")
+		exportjson   = flag.String("export-json", "", "Export duplicate files to a filename")
+		exportcsv    = flag.String("export-csv", "", "Export duplicate files to a filename")
+		clearindex   = flag.Bool("clear", false, "Clear all files in database")
+		purgeIndex   = flag.Bool("purgeIndex", false, "Remove non-existing files from database")
+		updateIndex  = flag.Bool("updateIndex", false, "Updates file hashes in the database")
+		include      = flag.String("include", "", "Comma separated patterns of files to add, globs (** for any directories) or regexes with the prefix re:")
+		exclude      = flag.String("exclude", "", "Comma separated patterns of files to skip when adding")
+		excludeDir   = flag.String("exclude-dir", "", "Comma separated patterns of directories that are not walked when adding (example: node_modules,.git)")
+		minSize      = flag.String("min-size", "", "Minimum size of added files (example: 10K), defaults to DF_MINSIZE")
+		maxSize      = flag.String("max-size", "", "Maximum size of added files (example: 2G)")
+		newer        = flag.String("newer", "", "Only add files modified on or after the date (YYYY-MM-DD)")
+		older        = flag.String("older", "", "Only add files modified before the date (YYYY-MM-DD)")
+		explain      = flag.String("explain", "", "Show which filter rule includes or excludes a path")
+		quickScan    = flag.String("qs", "", "Add path to database and scan for duplicates (example: ./df --qs /home/user/photos)")
+		move         = flag.String("move", "", "Move duplicate files to a new directory")
+		review       = flag.Bool("review", false, "Review the duplicate groups interactively and decide for every file")
+		moveMirror   = flag.String("move-mirror", "", "Move duplicate files to a new directory, keeping their directory structure")
+		trash        = flag.Bool("trash", false, "Move duplicate files to trash")
+		hardlink     = flag.Bool("hardlink", false, "Replace duplicate files with hard links to the kept file")
+		symlink      = flag.Bool("symlink", false, "Replace duplicate files with symbolic links to the kept file")
+		symlinkRel   = flag.Bool("symlink-relative", false, "Use relative targets for --symlink")
+		reflink      = flag.Bool("reflink", false, "Let duplicate files share their data blocks with the kept file (btrfs, XFS)")
+		keepRules    = flag.String("keep", "", "Comma separated rules deciding which duplicate is kept ("+strings.Join(core.KeepRuleNames(), ", ")+")")
+		keepPrefer   = flag.String("keep-prefer", "", "Comma separated directories whose files are kept first (rule: prefer)")
+		neverTouch   = flag.String("never-touch", "", "Comma separated glob patterns of files that are never moved, trashed or replaced")
+		protect      = flag.String("protect", "", "Protect a directory, its files are always kept and never modified")
+		unprotect    = flag.String("unprotect", "", "Remove the protection of a directory")
+		protected    = flag.Bool("protected", false, "Show all protected directories")
+		trashList    = flag.Bool("trash-list", false, "Show all files in the trash")
+		trashRestore = flag.String("trash-restore", "", "Restore a trashed file, or all trashed files from a directory, to the original path")
+		scans        = flag.Bool("scans", false, "Show all scan sessions")
+		scanDiff     = flag.String("scan-diff", "", "Show new, resolved and changed groups between two scan sessions (--scan-diff a b), b defaults to the latest")
+		jsonOutput   = flag.Bool("json", false, "Print the output of --scan-diff as JSON")
+		undo         = flag.String("undo", "", "Restore the files of a move, trash or link operation")
+		history      = flag.Bool("history", false, "Show all operations in the journal")
+		forget       = flag.Bool("forget", false, "Remove duplicate files from database")
+		headshot     = flag.Bool("headshot", false, "Remove hashes from database")
+		resume       = flag.Bool("resume", false, "Continue the last scan session if it was interrupted")
+		hashAlgo     = flag.String("hash", "", "Hash algorithm ("+strings.Join(core.HasherNames(), ", ")+")")
+		walkWorkers  = flag.Int("walk-workers", 0, "Directories read at the same time when adding files, defaults to DF_WALK_WORKERS")
+		hddWorkers   = flag.Int("hdd-workers", 0, "Files hashed or compared at the same time on a spinning disk, defaults to DF_HDD_WORKERS")
+		ssdWorkers   = flag.Int("ssd-workers", 0, "Files hashed or compared at the same time on an SSD, NVMe or network device, defaults to DF_SSD_WORKERS")
+		verifyMode   = flag.String("verify", "", "How files with the same hash are compared before they count as duplicates ("+strings.Join(core.VerifyModeNames(), ", ")+")")
+		benchWalk    = flag.Bool("benchmark-walk", false, "Compare the sequential and the parallel directory walk on a generated tree, or on a directory given after the flag")
+		benchLock    = flag.Bool("benchmark-lockstep", false, "Compare the lockstep comparison with hashing and verifying on generated files, or on a directory given after the flag")
+		dbMigrate    = flag.Bool("db-migrate", false, "Apply pending database migrations (use with --dry-run to list them)")
+		dryRun       = flag.Bool("dry-run", false, "Simulate changes, no files or database entries get touched")
 	)
 	flag.Parse()
 
+	// command line flags override the environment configuration
+	config := core.NewConfig()
+	if *hashAlgo != "" {
+		config.HashAlgorithm = *hashAlgo
+	}
+	if *verifyMode != "" {
+		config.VerifyMode = *verifyMode
+	}
+	if *walkWorkers > 0 {
+		config.WalkWorkers = *walkWorkers
+	}
+	if *hddWorkers > 0 {
+		config.HDDWorkers = *hddWorkers
+	}
+	if *ssdWorkers > 0 {
+		config.SSDWorkers = *ssdWorkers
+	}
+	if *dryRun {
+		config.DryRun = true
+	}
+	if *keepRules != "" {
+		config.KeepRules = core.SplitList(*keepRules)
+	}
+	if *keepPrefer != "" {
+		config.KeepPreferDirs = core.SplitList(*keepPrefer)
+	}
+	if *neverTouch != "" {
+		config.KeepNeverTouch = core.SplitList(*neverTouch)
+	}
+
+	// migrations run before the index gets opened
+	if *dbMigrate {
+		core.MigrateDatabase(config)
+		return
+	}
+
+	// filter for adding files, a pattern after the path (example: ./df --add /path/to/videos *.mp4) is an include pattern too
+	filterOptions := core.FilterOptions{
+		Include:     core.SplitList(*include),
+		Exclude:     core.SplitList(*exclude),
+		ExcludeDirs: core.SplitList(*excludeDir),
+		MinSize:     *minSize,
+		MaxSize:     *maxSize,
+		NewerThan:   *newer,
+		OlderThan:   *older,
+	}
+	if flag.NArg() > 0 {
+		filterOptions.Include = append(filterOptions.Include, flag.Arg(0))
+	}
+
+	// SIGINT and SIGTERM interrupt the running command, it saves its results so far. A second signal ends it at once.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
 	// start
-	app := core.NewApp()
+	app := core.NewAppWithContext(ctx, config)
 
 	switch {
 	case *showConfig:
@@ -46,26 +152,31 @@ func main() {
 		app.ShowHashes()
 	case *scan:
 		app.StartScan()
+	case *resume:
+		app.ResumeScan()
 	case *quickScan != "":
-		filter := ""
-		// do we have a filter in the arguments?
-		if flag.NArg() > 0 {
-			filter = flag.Arg(0)
-		}
 		// First add the path to database
-		app.AddPathToIndex(*quickScan, true, filter)
+		app.AddPathToIndex(*quickScan, *recursive, app.NewFilter(filterOptions))
 		// Then scan for duplicates
 		app.StartScan()
 	case *addPath != "":
-		//  todo: add parsing for recursive flag
-		filter := ""
-		// do we have a filter in the arguments?
-		if flag.NArg() > 0 {
-			filter = flag.Arg(0)
-		}
-		app.AddPathToIndex(*addPath, true, filter)
+		app.AddPathToIndex(*addPath, *recursive, app.NewFilter(filterOptions))
 	case *removePath != "":
 		app.RemovePathFromIndex(*removePath)
+	case *rootAdd != "":
+		app.AddRoot(*rootAdd, *rootLabel, *recursive, app.NewFilter(filterOptions))
+	case *benchWalk:
+		app.BenchmarkWalk(flag.Arg(0))
+	case *benchLock:
+		app.BenchmarkLockstep(flag.Arg(0))
+	case *explain != "":
+		app.Explain(*explain, app.NewFilter(filterOptions))
+	case *rootRemove != "":
+		app.RemoveRootFromIndex(*rootRemove)
+	case *roots:
+		app.ShowRoots()
+	case *rescanRoots:
+		app.RescanRoots()
 	case *export:
 		app.Export()
 	case *exportjson != "":
@@ -78,14 +189,48 @@ func main() {
 		app.IndexUpdate()
 	case *clearindex:
 		app.IndexClear()
+	case *protect != "":
+		app.ProtectPath(*protect)
+	case *unprotect != "":
+		app.UnprotectPath(*unprotect)
+	case *protected:
+		app.ShowProtectedRoots()
+	case *trashList:
+		app.ShowTrash()
+	case *trashRestore != "":
+		app.RestoreFromTrash(*trashRestore)
+	case *scans:
+		app.ShowScanSessions()
+	case *scanDiff != "":
+		to := ""
+		if flag.NArg() > 0 {
+			to = flag.Arg(0)
+			// flags after the second session, e.g. --json
+			flag.CommandLine.Parse(flag.Args()[1:])
+		}
+		app.ShowScanDiff(*scanDiff, to, *jsonOutput)
+	case *undo != "":
+		app.Undo(*undo)
+	case *history:
+		app.ShowHistory()
 	case *forget:
 		app.IndexForgetDuplicateFiles()
 	case *headshot:
 		app.IndexForgetHashes()
 	case *move != "":
 		app.MoveDuplicateFilesToDirectory(*move)
+	case *review:
+		app.ReviewDuplicateFiles()
+	case *moveMirror != "":
+		app.MoveDuplicateFilesMirrored(*moveMirror)
 	case *trash:
 		app.MoveDuplicateFilesToTrash()
+	case *hardlink:
+		app.HardlinkDuplicateFiles()
+	case *symlink:
+		app.SymlinkDuplicateFiles(*symlinkRel)
+	case *reflink:
+		app.ReflinkDuplicateFiles()
 	default:
 		// Default scan behavior
 		app.StartScan()